@@ -9,5 +9,7 @@ package include
 import (
 	// This list is automatically generated by `make imports`
 	_ "github.com/fpgeek/nvidiadockerbeat/module/nvidiadocker"
+	_ "github.com/fpgeek/nvidiadockerbeat/module/nvidiadocker/device"
 	_ "github.com/fpgeek/nvidiadockerbeat/module/nvidiadocker/status"
+	_ "github.com/fpgeek/nvidiadockerbeat/module/nvidiadocker/xid"
 )
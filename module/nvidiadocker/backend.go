@@ -0,0 +1,115 @@
+package nvidiadocker
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+const (
+	nvidiaSMIBackendName = "nvidia-smi"
+	pluginBackendName    = "plugin"
+)
+
+// DeviceStatusBackend collects the current status of every GPU on the host.
+type DeviceStatusBackend interface {
+	DeviceStatuses() ([]DeviceStatus, error)
+}
+
+// CloseDeviceStatusBackend stops the background work of a backend, if any.
+func CloseDeviceStatusBackend(backend DeviceStatusBackend) error {
+	if closer, ok := backend.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// NewDeviceStatusBackend returns the backend selected by the gpubackend setting.
+func NewDeviceStatusBackend(cfg Config) (DeviceStatusBackend, error) {
+	switch cfg.GPUBackend {
+	case "", nvidiaSMIBackendName:
+		queryGPUFields := cfg.QueryGPU
+		if len(queryGPUFields) == 0 {
+			queryGPUFields = DefaultQueryGPUFields
+		}
+		backend := &nvidiaSMIBackend{
+			command:  newNvidiaSMICommand(cfg),
+			queryGPU: nvidiaSMIQueryGPU(queryGPUFields),
+		}
+		if cfg.NvidiaSMIStream {
+			interval := cfg.NvidiaSMIInterval
+			if interval <= 0 {
+				interval = cfg.Period
+			}
+			backend.sampler = acquireNvidiaSMISampler(backend.command, backend.queryGPU, interval)
+		}
+		return backend, nil
+	case pluginBackendName:
+		return newPluginBackend(cfg.APIURL)
+	default:
+		return nil, fmt.Errorf("unknown gpubackend '%s', must be '%s' or '%s'",
+			cfg.GPUBackend, nvidiaSMIBackendName, pluginBackendName)
+	}
+}
+
+// nvidiaSMIBackend reads the GPU status by running nvidia-smi on the host,
+// either for every fetch or, with a sampler, once in loop mode.
+type nvidiaSMIBackend struct {
+	command  *nvidiaSMICommand
+	queryGPU string
+	sampler  *nvidiaSMISampler
+}
+
+func (b *nvidiaSMIBackend) DeviceStatuses() ([]DeviceStatus, error) {
+	deviceStatuses, err := b.gpuStatuses()
+	if err != nil {
+		return nil, err
+	}
+
+	// The compute processes only refine the per container memory, so the
+	// device status is still returned when they can't be queried.
+	processes, err := b.computeProcesses()
+	if err != nil {
+		logp.Warn("nvidiadocker: failed to query the GPU compute processes: %v", err)
+		return deviceStatuses, nil
+	}
+	for i := range deviceStatuses {
+		deviceStatuses[i].Processes = processes[deviceStatuses[i].UUID]
+	}
+	return deviceStatuses, nil
+}
+
+func (b *nvidiaSMIBackend) gpuStatuses() ([]DeviceStatus, error) {
+	if b.sampler != nil {
+		return b.sampler.DeviceStatuses()
+	}
+
+	output, err := b.command.run(b.queryGPU, nvidiaSMIFormatHeader)
+	if err != nil {
+		return nil, err
+	}
+	return getGPUDeviceStatus(output)
+}
+
+// Close releases the sampler, which is stopped when no other metricset
+// uses it. Only the tests close the backend; in the beat the sampler runs
+// until the beat exits.
+func (b *nvidiaSMIBackend) Close() error {
+	if b.sampler != nil {
+		return releaseNvidiaSMISampler(b.sampler)
+	}
+	return nil
+}
+
+func (b *nvidiaSMIBackend) computeProcesses() (map[string][]ProcessInfo, error) {
+	if b.sampler != nil {
+		return b.sampler.ComputeProcesses()
+	}
+
+	output, err := b.command.run(nvidiaSMIQueryComputeApps, nvidiaSMIFormatNoUnits)
+	if err != nil {
+		return nil, err
+	}
+	return getComputeProcesses(output)
+}
@@ -0,0 +1,86 @@
+package nvidiadocker
+
+import "time"
+
+const (
+	// DefaultKmsgPath is the kernel log device the xid metricset reads from.
+	DefaultKmsgPath = "/dev/kmsg"
+	// DefaultInspectWorkers is the number of containers inspected at a time.
+	DefaultInspectWorkers = 4
+)
+
+// Config is the nvidiadocker module configuration shared by all metricsets.
+type Config struct {
+	Runtime              string            `config:"runtime"`
+	DockerEndpoint       string            `config:"dockerendpoint"`
+	SSL                  *DockerTLSConfig  `config:"ssl"`
+	DockerAPIVersion     string            `config:"dockerapiversion"`
+	DockerConnectTimeout time.Duration     `config:"dockerconnecttimeout"`
+	DockerTimeout        time.Duration     `config:"dockertimeout"`
+	CRIEndpoint          string            `config:"criendpoint"`
+	CrictlPath           string            `config:"crictlpath"`
+	CrictlWrapper        []string          `config:"crictlwrapper"`
+	APIURL               string            `config:"apiurl"`
+	GPUBackend           string            `config:"gpubackend"`
+	ProcPath             string            `config:"procpath"`
+	QueryGPU             []string          `config:"querygpu"`
+	PerPod               bool              `config:"perpod"`
+	KubeletCheckpoint    string            `config:"kubeletcheckpoint"`
+	Aggregates           []string          `config:"aggregates"`
+	IdleThreshold        float64           `config:"idlethreshold"`
+	IdleDuration         time.Duration     `config:"idleduration"`
+	KmsgPath             string            `config:"kmsgpath"`
+	PrometheusListen     string            `config:"prometheuslisten"`
+	PrometheusLabels     []string          `config:"prometheuslabels"`
+	NvidiaSMIPath        string            `config:"nvidiasmipath"`
+	NvidiaSMIWrapper     []string          `config:"nvidiasmiwrapper"`
+	NvidiaSMIArgs        []string          `config:"nvidiasmiargs"`
+	NvidiaSMIEnv         []string          `config:"nvidiasmienv"`
+	NvidiaSMITimeout     time.Duration     `config:"nvidiasmitimeout"`
+	NvidiaSMIStream      bool              `config:"nvidiasmistream"`
+	NvidiaSMIInterval    time.Duration     `config:"nvidiasmiinterval"`
+	InspectWorkers       int               `config:"inspectworkers"`
+	FetchTimeout         time.Duration     `config:"fetchtimeout"`
+	GPUOnly              bool              `config:"gpuonly"`
+	IncludeNames         []string          `config:"includenames"`
+	ExcludeNames         []string          `config:"excludenames"`
+	IncludeImages        []string          `config:"includeimages"`
+	ExcludeImages        []string          `config:"excludeimages"`
+	IncludeLabels        []string          `config:"includelabels"`
+	ExcludeLabels        []string          `config:"excludelabels"`
+	LabelDedot           bool              `config:"labeldedot"`
+	LabelAllow           []string          `config:"labelallow"`
+	LabelDeny            []string          `config:"labeldeny"`
+	LabelFields          map[string]string `config:"labelfields"`
+	// Period is the period of the metricset, the default nvidia-smi and
+	// fetch timeout.
+	Period time.Duration `config:"period"`
+}
+
+// DefaultConfig returns the module configuration with the default values populated.
+func DefaultConfig() Config {
+	return Config{
+		Runtime:              dockerRuntimeName,
+		DockerEndpoint:       "",
+		DockerConnectTimeout: DefaultDockerConnectTimeout,
+		CRIEndpoint:          DefaultCRIEndpoint,
+		CrictlPath:           DefaultCrictlPath,
+		GPUBackend:           nvidiaSMIBackendName,
+		ProcPath:             "/proc",
+		KubeletCheckpoint:    DefaultKubeletCheckpointPath,
+		IdleThreshold:        5,
+		KmsgPath:             DefaultKmsgPath,
+		NvidiaSMIPath:        DefaultNvidiaSMIPath,
+		InspectWorkers:       DefaultInspectWorkers,
+		Period:               10 * time.Second,
+	}
+}
+
+// fetchTimeout returns the deadline for listing and inspecting the containers
+// of a fetch, which defaults to the period.
+func (c Config) fetchTimeout() time.Duration {
+	if c.FetchTimeout > 0 {
+		return c.FetchTimeout
+	}
+	return c.Period
+}
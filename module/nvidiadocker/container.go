@@ -0,0 +1,445 @@
+package nvidiadocker
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/elastic/beats/libbeat/logp"
+	docker "github.com/fpgeek/go-dockerclient"
+)
+
+const (
+	nvidiaRuntimeName          = "nvidia"
+	nvidiaVisibleDevicesENVKey = "NVIDIA_VISIBLE_DEVICES"
+	nvidiaVisibleDevicesAll    = "all"
+	nvidiaVisibleDevicesNone   = "none"
+	nvidiaVisibleDevicesVoid   = "void"
+
+	// Sources a GPU assignment of a container can come from.
+	GPUSourceDeviceRequest = "device_request"
+	GPUSourceEnv           = "env"
+	GPUSourceDeviceNode    = "device_node"
+	GPUSourceKubelet       = "kubelet"
+)
+
+var (
+	nvidiaDeviceRegexp = regexp.MustCompile("^/dev/nvidia([0-9]+)$")
+)
+
+type containerInspector interface {
+	InspectContainerWithContext(id string, ctx context.Context) (*docker.Container, error)
+}
+
+// InspectError is returned together with the inspected containers when other
+// containers weren't inspected, either because the fetch deadline was reached
+// before they were inspected or because their inspection failed. Containers
+// removed in the meantime are gone, so they are not reported.
+type InspectError struct {
+	TimedOut []string
+	Failed   []ContainerError
+}
+
+// ContainerError is the reason a container couldn't be inspected.
+type ContainerError struct {
+	ID   string
+	Name string
+	Err  error
+}
+
+func (e *InspectError) Error() string {
+	var problems []string
+	if len(e.TimedOut) > 0 {
+		problems = append(problems, fmt.Sprintf("timed out inspecting %d containers: %s", len(e.TimedOut), strings.Join(e.TimedOut, ", ")))
+	}
+	if len(e.Failed) > 0 {
+		failed := make([]string, 0, len(e.Failed))
+		for _, containerErr := range e.Failed {
+			failed = append(failed, fmt.Sprintf("%s: %v", containerErr.ID, containerErr.Err))
+		}
+		problems = append(problems, fmt.Sprintf("failed to inspect %d containers: %s", len(e.Failed), strings.Join(failed, ", ")))
+	}
+	return strings.Join(problems, "; ")
+}
+
+// FailedIDs returns the IDs of the containers whose inspection failed.
+func (e *InspectError) FailedIDs() []string {
+	ids := make([]string, 0, len(e.Failed))
+	for _, containerErr := range e.Failed {
+		ids = append(ids, containerErr.ID)
+	}
+	return ids
+}
+
+// Skipped returns the number of containers which weren't inspected.
+func (e *InspectError) Skipped() int {
+	return len(e.TimedOut) + len(e.Failed)
+}
+
+// newInspectError returns an *InspectError for the containers which weren't
+// inspected, or nil if all were.
+func newInspectError(timedOut []string, failed []ContainerError) error {
+	if len(timedOut) == 0 && len(failed) == 0 {
+		return nil
+	}
+	return &InspectError{TimedOut: timedOut, Failed: failed}
+}
+
+// InspectContainers inspects the given containers with up to workers
+// inspections at a time. Containers removed in the meantime are skipped. The
+// containers which couldn't be inspected, or weren't inspected before ctx is
+// done, are reported with an *InspectError.
+func InspectContainers(ctx context.Context, client containerInspector, apiContainers []docker.APIContainers, workers int) ([]*docker.Container, error) {
+	results, errs, timedOut := inspectConcurrently(ctx, len(apiContainers), workers, func(ctx context.Context, i int) (interface{}, error) {
+		container, err := client.InspectContainerWithContext(apiContainers[i].ID, ctx)
+		if _, removed := err.(*docker.NoSuchContainer); removed {
+			return nil, nil
+		}
+		return container, err
+	})
+
+	var (
+		containers = make([]*docker.Container, 0, len(apiContainers))
+		failed     []ContainerError
+	)
+	for i, result := range results {
+		if errs[i] != nil {
+			failed = append(failed, ContainerError{
+				ID:   apiContainers[i].ID,
+				Name: strings.TrimPrefix(apiContainerName(apiContainers[i]), "/"),
+				Err:  errs[i],
+			})
+		} else if result != nil {
+			containers = append(containers, result.(*docker.Container))
+		}
+	}
+
+	var timedOutIDs []string
+	for _, i := range timedOut {
+		timedOutIDs = append(timedOutIDs, apiContainers[i].ID)
+	}
+	return containers, newInspectError(timedOutIDs, failed)
+}
+
+// inspectConcurrently calls inspect for 0 to n-1 with up to workers calls at
+// a time until all calls returned or ctx is done. It returns the results and
+// errors of the calls by index, and the indices of the calls which didn't
+// complete before ctx was done. A call may return neither a result nor an
+// error for an item which is gone. Calls still running when ctx is done are
+// left behind, their results are discarded.
+func inspectConcurrently(ctx context.Context, n int, workers int, inspect func(ctx context.Context, i int) (interface{}, error)) ([]interface{}, []error, []int) {
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > n {
+		workers = n
+	}
+
+	var (
+		mu        sync.Mutex
+		results   = make([]interface{}, n)
+		errs      = make([]error, n)
+		completed = make([]bool, n)
+		jobs      = make(chan int)
+		wg        sync.WaitGroup
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				result, err := inspect(ctx, i)
+				if err != nil && ctx.Err() != nil {
+					// Failed because of the deadline, so it timed out.
+					continue
+				}
+
+				mu.Lock()
+				completed[i] = true
+				results[i] = result
+				errs[i] = err
+				mu.Unlock()
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for i := 0; i < n; i++ {
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	var (
+		collected     = make([]interface{}, n)
+		collectedErrs = make([]error, n)
+		timedOut      []int
+	)
+	for i := 0; i < n; i++ {
+		if completed[i] {
+			collected[i] = results[i]
+			collectedErrs[i] = errs[i]
+		} else {
+			timedOut = append(timedOut, i)
+		}
+	}
+	return collected, collectedErrs, timedOut
+}
+
+// GPUAssignment is a GPU assigned to a container together with the sources
+// the assignment was found in.
+type GPUAssignment struct {
+	Index   int
+	Sources []string
+}
+
+// GetGPUAssignments returns the GPUs assigned to the container. A GPU device
+// request is the only source when the container has one, as the
+// NVIDIA_VISIBLE_DEVICES of the image, e.g. `all` in the CUDA images, doesn't
+// apply then. Otherwise the GPUs are merged from NVIDIA_VISIBLE_DEVICES and
+// /dev/nvidiaN device mappings. GPU UUIDs and device minor numbers are
+// resolved against the given devices of the host.
+// If the kubelet allocated GPUs to the container, its allocation is the source
+// of truth and the other sources only add to the sources of those GPUs, unless
+// none of its GPUs is known, e.g. MIG devices.
+func GetGPUAssignments(container *Container, gpuDevices []DeviceStatus, kubeletAllocations KubeletAllocations) []GPUAssignment {
+	var assignments []GPUAssignment
+	addAssignments := func(source string, deviceIndices []int) {
+		for _, deviceIndex := range deviceIndices {
+			found := false
+			for i := range assignments {
+				if assignments[i].Index == deviceIndex {
+					assignments[i].Sources = appendSource(assignments[i].Sources, source)
+					found = true
+					break
+				}
+			}
+			if !found {
+				assignments = append(assignments, GPUAssignment{
+					Index:   deviceIndex,
+					Sources: []string{source},
+				})
+			}
+		}
+	}
+
+	if deviceIndices, found := getNvidiaDevicesFromDeviceRequests(container.DeviceRequests, gpuDevices); found {
+		addAssignments(GPUSourceDeviceRequest, deviceIndices)
+	} else {
+		addAssignments(GPUSourceEnv, getNvidiaDevicesFromEnvs(container.Env, gpuDevices))
+		addAssignments(GPUSourceDeviceNode, getNvidiaDevicesFromDeviceNodes(container.DevicePaths, gpuDevices))
+	}
+
+	if deviceIDs, found := kubeletAllocations.DeviceIDs(container.Labels); found {
+		if deviceIndices := getNvidiaDevicesFromDeviceIDs(deviceIDs, gpuDevices); len(deviceIndices) > 0 {
+			return getKubeletAssignments(deviceIndices, assignments)
+		}
+		logp.Debug("nvidiadocker", "none of the GPUs %v the kubelet allocated to container %s is known, using the other sources", deviceIDs, container.ID)
+	}
+	return assignments
+}
+
+func getKubeletAssignments(deviceIndices []int, assignments []GPUAssignment) []GPUAssignment {
+	kubeletAssignments := make([]GPUAssignment, 0, len(deviceIndices))
+	for _, deviceIndex := range deviceIndices {
+		sources := []string{GPUSourceKubelet}
+		for _, assignment := range assignments {
+			if assignment.Index == deviceIndex {
+				for _, source := range assignment.Sources {
+					sources = appendSource(sources, source)
+				}
+			}
+		}
+		kubeletAssignments = append(kubeletAssignments, GPUAssignment{
+			Index:   deviceIndex,
+			Sources: sources,
+		})
+	}
+	return kubeletAssignments
+}
+
+// GetGPUDeviceIndices returns the indices of the GPUs assigned to the container.
+func GetGPUDeviceIndices(container *Container, gpuDevices []DeviceStatus, kubeletAllocations KubeletAllocations) []int {
+	assignments := GetGPUAssignments(container, gpuDevices, kubeletAllocations)
+	deviceIndices := make([]int, 0, len(assignments))
+	for _, assignment := range assignments {
+		deviceIndices = append(deviceIndices, assignment.Index)
+	}
+	return deviceIndices
+}
+
+// getNvidiaDevicesFromDeviceRequests returns the GPUs of the first GPU device
+// request, and false if the container has none.
+func getNvidiaDevicesFromDeviceRequests(deviceRequests []DeviceRequest, gpuDevices []DeviceStatus) ([]int, bool) {
+	for _, deviceReq := range deviceRequests {
+		if isIncludeGPUCapability(deviceReq.Capabilities) {
+			if len(deviceReq.DeviceIDs) == 0 {
+				return getNvidiaDevicesFromCount(deviceReq.Count, gpuDevices), true
+			}
+			return getNvidiaDevicesFromDeviceIDs(deviceReq.DeviceIDs, gpuDevices), true
+		}
+	}
+	return nil, false
+}
+
+func getNvidiaDevicesFromEnvs(env []string, gpuDevices []DeviceStatus) []int {
+	deviceIndices := make([]int, 0, 8)
+	for _, envStr := range env {
+		if strings.HasPrefix(envStr, fmt.Sprintf("%s=", nvidiaVisibleDevicesENVKey)) {
+			splitEnvStrs := strings.Split(envStr, "=")
+			if len(splitEnvStrs) == 2 {
+				deviceIndices = append(deviceIndices,
+					getNvidiaDevicesFromDeviceIDs(strings.Split(splitEnvStrs[1], ","), gpuDevices)...)
+			}
+		}
+	}
+	return deviceIndices
+}
+
+// getNvidiaDevicesFromDeviceIDs resolves GPU indices, UUIDs and the special
+// values "all", "none" and "void" the same way the NVIDIA container runtime does.
+func getNvidiaDevicesFromDeviceIDs(strDeviceIDs []string, gpuDevices []DeviceStatus) []int {
+	deviceIndices := make([]int, 0, 8)
+	for _, strDeviceID := range strDeviceIDs {
+		strDeviceID = strings.TrimSpace(strDeviceID)
+		switch strDeviceID {
+		case nvidiaVisibleDevicesAll:
+			return getNvidiaDevicesFromCount(-1, gpuDevices)
+		case nvidiaVisibleDevicesNone, nvidiaVisibleDevicesVoid:
+			return []int{}
+		}
+
+		if deviceIndex, err := strconv.ParseInt(strDeviceID, 10, 64); err == nil {
+			deviceIndices = append(deviceIndices, int(deviceIndex))
+		} else if deviceIndex, found := findDeviceIndexByUUID(strDeviceID, gpuDevices); found {
+			deviceIndices = append(deviceIndices, deviceIndex)
+		}
+	}
+	return deviceIndices
+}
+
+// getNvidiaDevicesFromCount returns the first count GPUs, or all GPUs if
+// count is -1, as Docker assigns them for `--gpus <count>`.
+func getNvidiaDevicesFromCount(count int, gpuDevices []DeviceStatus) []int {
+	if count < 0 || count > len(gpuDevices) {
+		count = len(gpuDevices)
+	}
+
+	deviceIndices := make([]int, 0, count)
+	for i := 0; i < count; i++ {
+		deviceIndices = append(deviceIndices, DeviceIndex(i, &gpuDevices[i]))
+	}
+	return deviceIndices
+}
+
+func findDeviceIndexByUUID(uuid string, gpuDevices []DeviceStatus) (int, bool) {
+	for i := range gpuDevices {
+		if gpuDevices[i].UUID != "" && strings.EqualFold(gpuDevices[i].UUID, uuid) {
+			return DeviceIndex(i, &gpuDevices[i]), true
+		}
+	}
+	return 0, false
+}
+
+// DevicesByIndex returns the devices keyed by their GPU index, which isn't
+// their position in the list when only some GPUs are reported, e.g. with
+// `nvidia-smi -i` or when a GPU stopped reporting.
+func DevicesByIndex(gpuDevices []DeviceStatus) map[int]*DeviceStatus {
+	devices := make(map[int]*DeviceStatus, len(gpuDevices))
+	for i := range gpuDevices {
+		devices[DeviceIndex(i, &gpuDevices[i])] = &gpuDevices[i]
+	}
+	return devices
+}
+
+// DeviceIndex returns the GPU index of a device, or its position in the list
+// of devices if the index isn't known.
+func DeviceIndex(position int, device *DeviceStatus) int {
+	if device.Index != nil {
+		return int(*device.Index)
+	}
+	return position
+}
+
+// getNvidiaDevicesFromDeviceNodes returns the GPUs mapped into the container as
+// /dev/nvidiaN device nodes, as nvidia-docker v1 and `--device` do. N is the
+// minor number of the device, which isn't necessarily its index, so nodes of
+// devices without a known minor number are skipped.
+func getNvidiaDevicesFromDeviceNodes(devicePaths []string, gpuDevices []DeviceStatus) []int {
+	deviceIndices := make([]int, 0, len(devicePaths))
+	for _, devicePath := range devicePaths {
+		minorNumber, ok := parseNvidiaDeviceMinor(devicePath)
+		if !ok {
+			continue
+		}
+		if deviceIndex, found := findDeviceIndexByMinorNumber(minorNumber, gpuDevices); found {
+			deviceIndices = append(deviceIndices, deviceIndex)
+		} else {
+			logp.Debug("nvidiadocker", "no GPU with the minor number of the device node %s", devicePath)
+		}
+	}
+	return deviceIndices
+}
+
+// parseNvidiaDeviceMinor returns the minor number N of a /dev/nvidiaN device
+// node.
+func parseNvidiaDeviceMinor(devicePath string) (uint, bool) {
+	findStrs := nvidiaDeviceRegexp.FindStringSubmatch(devicePath)
+	if findStrs == nil {
+		return 0, false
+	}
+	minorNumber, err := strconv.ParseUint(findStrs[1], 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint(minorNumber), true
+}
+
+func findDeviceIndexByMinorNumber(minorNumber uint, gpuDevices []DeviceStatus) (int, bool) {
+	for i := range gpuDevices {
+		if gpuDevices[i].MinorNumber != nil && *gpuDevices[i].MinorNumber == minorNumber {
+			return DeviceIndex(i, &gpuDevices[i]), true
+		}
+	}
+	return 0, false
+}
+
+func appendSource(sources []string, source string) []string {
+	for _, s := range sources {
+		if s == source {
+			return sources
+		}
+	}
+	return append(sources, source)
+}
+
+func isIncludeGPUCapability(capabilities [][]string) bool {
+	for _, caps := range capabilities {
+		for _, capValue := range caps {
+			if capValue == "gpu" {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,248 @@
+package nvidiadocker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNvidiaDeviceRegexp(t *testing.T) {
+	testDatas := []struct {
+		DeviceName  string
+		DeviceIndex string
+		Matched     bool
+	}{
+		{
+			"/dev/nvidia0",
+			"0",
+			true,
+		},
+		{
+			"/dev/nvidia12",
+			"12",
+			true,
+		},
+		{
+			"/dev/test0",
+			"",
+			false,
+		},
+		{
+			"/nvidia0",
+			"",
+			false,
+		},
+		{
+			"/dev/nvidia",
+			"",
+			false,
+		},
+	}
+
+	for _, testData := range testDatas {
+		findStrs := nvidiaDeviceRegexp.FindStringSubmatch(testData.DeviceName)
+		if (findStrs != nil) != testData.Matched {
+			t.Fatal("not matched")
+		}
+
+		if testData.Matched {
+			if !reflect.DeepEqual([]string{testData.DeviceName, testData.DeviceIndex}, findStrs) {
+				t.Fatal("not matched")
+			}
+		}
+
+	}
+}
+
+func TestGetNvidiaVisibleDevices(t *testing.T) {
+	tests := []struct {
+		ENV    []string
+		Result []int
+	}{
+		{
+			ENV:    []string{"NVIDIA_VISIBLE_DEVICES=3"},
+			Result: []int{3},
+		},
+		{
+			ENV:    []string{"NVIDIA_VISIBLE_DEVICES=0,1,2,3"},
+			Result: []int{0, 1, 2, 3},
+		},
+		{
+			ENV:    []string{"NVIDIA_VISIBLE_DEVICES=5,1"},
+			Result: []int{5, 1},
+		},
+		{
+			ENV:    []string{"ABC=BCD"},
+			Result: []int{},
+		},
+		{
+			ENV:    []string{"NVIDIA_VISIBLE_DEVICES=GPU-535c289c-6dd8-e308-b4ca-524b0fc07fa6,0"},
+			Result: []int{1, 0},
+		},
+		{
+			ENV:    []string{"NVIDIA_VISIBLE_DEVICES=GPU-00000000-0000-0000-0000-000000000000"},
+			Result: []int{},
+		},
+		{
+			ENV:    []string{"NVIDIA_VISIBLE_DEVICES=all"},
+			Result: []int{0, 1, 2},
+		},
+		{
+			ENV:    []string{"NVIDIA_VISIBLE_DEVICES=none"},
+			Result: []int{},
+		},
+		{
+			ENV:    []string{"NVIDIA_VISIBLE_DEVICES=void"},
+			Result: []int{},
+		},
+	}
+	for _, test := range tests {
+		deviceIndices := getNvidiaDevicesFromEnvs(test.ENV, testGPUDevices)
+		if !reflect.DeepEqual(deviceIndices, test.Result) {
+			t.Fatal("failed")
+		}
+	}
+}
+
+func TestGetGPUDeviceIndicesFromDeviceRequests(t *testing.T) {
+	tests := []struct {
+		DeviceRequest DeviceRequest
+		Result        []int
+	}{
+		{
+			DeviceRequest: DeviceRequest{Count: -1, Capabilities: [][]string{{"gpu"}}},
+			Result:        []int{0, 1, 2},
+		},
+		{
+			DeviceRequest: DeviceRequest{Count: 2, Capabilities: [][]string{{"gpu"}}},
+			Result:        []int{0, 1},
+		},
+		{
+			DeviceRequest: DeviceRequest{DeviceIDs: []string{"2", "GPU-66a2874a-837d-cd53-ab26-0d2d842d9822"}, Capabilities: [][]string{{"gpu"}}},
+			Result:        []int{2, 0},
+		},
+	}
+	for _, test := range tests {
+		deviceIndices := GetGPUDeviceIndices(&Container{
+			DeviceRequests: []DeviceRequest{test.DeviceRequest},
+			Env:            []string{"NVIDIA_VISIBLE_DEVICES=none"},
+		}, testGPUDevices, nil)
+		if !reflect.DeepEqual(deviceIndices, test.Result) {
+			t.Fatalf("expected %v, got %v", test.Result, deviceIndices)
+		}
+	}
+}
+
+func TestGetGPUAssignments(t *testing.T) {
+	// The device nodes are mapped by their minor number, the node of an
+	// unknown minor number is skipped.
+	assignments := GetGPUAssignments(&Container{
+		DevicePaths: []string{"/dev/nvidiactl", "/dev/nvidia0", "/dev/nvidia1", "/dev/nvidia7"},
+		Env:         []string{"NVIDIA_VISIBLE_DEVICES=0,1"},
+	}, testGPUDevices, nil)
+
+	expected := []GPUAssignment{
+		{Index: 0, Sources: []string{GPUSourceEnv, GPUSourceDeviceNode}},
+		{Index: 1, Sources: []string{GPUSourceEnv}},
+		{Index: 2, Sources: []string{GPUSourceDeviceNode}},
+	}
+	if !reflect.DeepEqual(assignments, expected) {
+		t.Fatalf("expected %v, got %v", expected, assignments)
+	}
+}
+
+func TestGetGPUAssignmentsFromDeviceRequest(t *testing.T) {
+	// `--gpus device=1` of an image setting NVIDIA_VISIBLE_DEVICES=all, like
+	// the CUDA images, is only assigned the requested GPU.
+	assignments := GetGPUAssignments(&Container{
+		DeviceRequests: []DeviceRequest{{DeviceIDs: []string{"1"}, Capabilities: [][]string{{"gpu"}}}},
+		Env:            []string{"NVIDIA_VISIBLE_DEVICES=all"},
+	}, testGPUDevices, nil)
+
+	expected := []GPUAssignment{
+		{Index: 1, Sources: []string{GPUSourceDeviceRequest}},
+	}
+	if !reflect.DeepEqual(assignments, expected) {
+		t.Fatalf("expected %v, got %v", expected, assignments)
+	}
+}
+
+func TestGetGPUAssignmentsFromKubelet(t *testing.T) {
+	labels := map[string]string{
+		"io.kubernetes.container.name": "trainer",
+		"io.kubernetes.pod.uid":        "535c289c-6dd8-e308-b4ca-524b0fc07fa6",
+	}
+	allocations := KubeletAllocations{
+		{podUID: "535c289c-6dd8-e308-b4ca-524b0fc07fa6", containerName: "trainer"}: {
+			"GPU-149648d8-7e32-715a-b5c3-fe6df5976c7e",
+			"GPU-535c289c-6dd8-e308-b4ca-524b0fc07fa6",
+		},
+	}
+
+	assignments := GetGPUAssignments(&Container{
+		Env:    []string{"NVIDIA_VISIBLE_DEVICES=all"},
+		Labels: labels,
+	}, testGPUDevices, allocations)
+
+	expected := []GPUAssignment{
+		{Index: 2, Sources: []string{GPUSourceKubelet, GPUSourceEnv}},
+		{Index: 1, Sources: []string{GPUSourceKubelet, GPUSourceEnv}},
+	}
+	if !reflect.DeepEqual(assignments, expected) {
+		t.Fatalf("expected %v, got %v", expected, assignments)
+	}
+
+	// Containers the kubelet didn't allocate GPUs to keep their own sources.
+	labels["io.kubernetes.container.name"] = "sidecar"
+	assignments = GetGPUAssignments(&Container{
+		Env:    []string{"NVIDIA_VISIBLE_DEVICES=0"},
+		Labels: labels,
+	}, testGPUDevices, allocations)
+
+	expected = []GPUAssignment{
+		{Index: 0, Sources: []string{GPUSourceEnv}},
+	}
+	if !reflect.DeepEqual(assignments, expected) {
+		t.Fatalf("expected %v, got %v", expected, assignments)
+	}
+
+	// The replicas of a GPU shared by time-slicing are the GPU.
+	allocations[kubeletContainerKey{podUID: "535c289c-6dd8-e308-b4ca-524b0fc07fa6", containerName: "sidecar"}] = []string{
+		"GPU-535c289c-6dd8-e308-b4ca-524b0fc07fa6::3",
+		"GPU-535c289c-6dd8-e308-b4ca-524b0fc07fa6::7",
+	}
+	assignments = GetGPUAssignments(&Container{
+		Env:    []string{"NVIDIA_VISIBLE_DEVICES=GPU-535c289c-6dd8-e308-b4ca-524b0fc07fa6"},
+		Labels: labels,
+	}, testGPUDevices, allocations)
+
+	expected = []GPUAssignment{
+		{Index: 1, Sources: []string{GPUSourceKubelet, GPUSourceEnv}},
+	}
+	if !reflect.DeepEqual(assignments, expected) {
+		t.Fatalf("expected %v, got %v", expected, assignments)
+	}
+
+	// An allocation of unknown GPUs doesn't hide the other sources.
+	allocations[kubeletContainerKey{podUID: "535c289c-6dd8-e308-b4ca-524b0fc07fa6", containerName: "sidecar"}] = []string{
+		"MIG-4a8c7d6e-5b1f-5c2a-9e3d-7f6a5b4c3d2e",
+	}
+	assignments = GetGPUAssignments(&Container{
+		Env:    []string{"NVIDIA_VISIBLE_DEVICES=0"},
+		Labels: labels,
+	}, testGPUDevices, allocations)
+
+	expected = []GPUAssignment{
+		{Index: 0, Sources: []string{GPUSourceEnv}},
+	}
+	if !reflect.DeepEqual(assignments, expected) {
+		t.Fatalf("expected %v, got %v", expected, assignments)
+	}
+}
+
+// testGPUDevices have minor numbers in another order than their index, as
+// the index follows the PCI bus order.
+var testGPUDevices = []DeviceStatus{
+	{Index: toUintP(0), MinorNumber: toUintP(0), UUID: "GPU-66a2874a-837d-cd53-ab26-0d2d842d9822"},
+	{Index: toUintP(1), MinorNumber: toUintP(2), UUID: "GPU-535c289c-6dd8-e308-b4ca-524b0fc07fa6"},
+	{Index: toUintP(2), MinorNumber: toUintP(1), UUID: "GPU-149648d8-7e32-715a-b5c3-fe6df5976c7e"},
+}
@@ -0,0 +1,484 @@
+package nvidiadocker
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/libbeat/logp"
+	docker "github.com/fpgeek/go-dockerclient"
+)
+
+const (
+	containerEventsBufferSize = 100
+	containerEventsRetryWait  = 5 * time.Second
+	// containerCacheIdlePeriods is the number of periods without a fetch
+	// after which the cache of a metricset stops watching the Docker events.
+	containerCacheIdlePeriods = 3
+)
+
+// containerClient is the part of the Docker client used by the ContainerCache.
+type containerClient interface {
+	ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error)
+	InspectContainerWithContext(id string, ctx context.Context) (*docker.Container, error)
+	AddEventListener(listener chan<- *docker.APIEvents) error
+	RemoveEventListener(listener chan *docker.APIEvents) error
+}
+
+// ContainerCache keeps the inspected running containers in memory. It is
+// seeded with a full list and inspect and then kept up to date from the
+// Docker event stream, so only containers which changed are inspected again.
+// The cache is resynced with a full list after the event stream was lost.
+// Metricbeat doesn't close its metricsets, so the cache stops watching the
+// event stream when it isn't used for its idle timeout, e.g. after its
+// metricset was stopped by a config reload, and watches it again when it is
+// used again.
+type ContainerCache struct {
+	client      containerClient
+	retryWait   time.Duration
+	filter      *ContainerFilter
+	workers     int
+	timeout     time.Duration
+	idleTimeout time.Duration
+
+	// startMu guards the watch of the event stream, which runs until stop
+	// is closed and closes stopped when it returns.
+	startMu  sync.Mutex
+	lastUsed time.Time
+	stop     chan struct{}
+	stopped  chan struct{}
+	// resyncMu serializes the resyncs, which list and inspect the
+	// containers without holding mu.
+	resyncMu   sync.Mutex
+	mu         sync.RWMutex
+	watching   bool
+	synced     bool
+	containers map[string]*docker.Container
+	// excluded are the IDs of the running containers which don't match the
+	// filter.
+	excluded map[string]bool
+	// seq numbers the observations of the containers, so an observation
+	// doesn't overwrite a newer one: updated is the seq at which an event
+	// observed a container, and resynced the seq at which the last resync
+	// started. updated is only needed while observations are pending.
+	// invalidated is the seq at which the cache last went out of sync.
+	seq         uint64
+	pending     int
+	updated     map[string]uint64
+	resynced    uint64
+	invalidated uint64
+}
+
+// NewContainerCache returns a cache of the running containers of the client.
+// The event stream is subscribed on the first call to Containers, before the
+// containers are listed, so no event is missed in between. Only the
+// containers matching the filter are inspected and cached. Up to workers
+// containers are inspected at a time, and listing and inspecting the
+// containers is given up after timeout. The event stream is watched until the
+// cache isn't used for idleTimeout, or forever if it is 0.
+func NewContainerCache(client containerClient, filter *ContainerFilter, workers int, timeout, idleTimeout time.Duration) *ContainerCache {
+	return &ContainerCache{
+		client:      client,
+		retryWait:   containerEventsRetryWait,
+		filter:      filter,
+		workers:     workers,
+		timeout:     timeout,
+		idleTimeout: idleTimeout,
+		containers:  map[string]*docker.Container{},
+		excluded:    map[string]bool{},
+		updated:     map[string]uint64{},
+	}
+}
+
+// Containers returns the running containers, newest first. The containers are
+// listed and inspected only if the cache is not in sync with the event stream.
+// If not all containers are inspected, because of the timeout or because
+// their inspection failed, the inspected containers are returned with an
+// *InspectError and the containers are listed again on the next call.
+func (c *ContainerCache) Containers() ([]*docker.Container, error) {
+	c.start()
+
+	c.mu.RLock()
+	synced := c.synced
+	c.mu.RUnlock()
+	var inspectErr error
+	if !synced {
+		err := c.resync()
+		if _, partial := err.(*InspectError); partial {
+			inspectErr = err
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	c.mu.RLock()
+	containers := make([]*docker.Container, 0, len(c.containers))
+	for _, container := range c.containers {
+		containers = append(containers, container)
+	}
+	c.mu.RUnlock()
+
+	sort.Sort(containersByCreated(containers))
+	return containers, inspectErr
+}
+
+// resync replaces the cached containers with a full list. The containers are
+// listed and inspected without holding the lock, so events keep being applied
+// meanwhile, and the containers observed by an event after the resync started
+// are kept as the event left them.
+func (c *ContainerCache) resync() error {
+	c.resyncMu.Lock()
+	defer c.resyncMu.Unlock()
+
+	c.mu.Lock()
+	if c.synced {
+		c.mu.Unlock()
+		return nil
+	}
+	start := c.observe()
+	c.mu.Unlock()
+
+	ctx, cancel := c.requestContext()
+	defer cancel()
+
+	listed, err := c.client.ListContainers(docker.ListContainersOptions{Context: ctx})
+	if err != nil {
+		c.mu.Lock()
+		c.done()
+		c.mu.Unlock()
+		return err
+	}
+
+	// The containers are filtered before they are inspected, as the list
+	// has their names, images and labels. All containers are listed, so the
+	// excluded ones are known.
+	apiContainers := make([]docker.APIContainers, 0, len(listed))
+	excluded := map[string]bool{}
+	for _, apiContainer := range listed {
+		if c.filter.Match(apiContainerName(apiContainer), apiContainer.Image, apiContainer.Labels) {
+			apiContainers = append(apiContainers, apiContainer)
+		} else {
+			excluded[apiContainer.ID] = true
+		}
+	}
+
+	inspected, inspectErr := InspectContainers(ctx, c.client, apiContainers, c.workers)
+	containers := make(map[string]*docker.Container, len(apiContainers))
+	for _, container := range inspected {
+		containers[container.ID] = container
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.done()
+	for id, seq := range c.updated {
+		if seq < start {
+			continue
+		}
+		delete(containers, id)
+		delete(excluded, id)
+		if container, found := c.containers[id]; found {
+			containers[id] = container
+		}
+		if c.excluded[id] {
+			excluded[id] = true
+		}
+	}
+	c.containers = containers
+	c.excluded = excluded
+	c.resynced = start
+	if inspectErr != nil {
+		// The cache stays out of sync, so the next call lists the containers
+		// again instead of missing the skipped ones until they change.
+		return inspectErr
+	}
+	// Events may have been missed if the cache went out of sync meanwhile.
+	c.synced = c.watching && c.invalidated < start
+	return nil
+}
+
+// requestContext returns the context of a list or inspect, which is canceled
+// after the timeout of the cache.
+func (c *ContainerCache) requestContext() (context.Context, context.CancelFunc) {
+	if c.timeout > 0 {
+		return context.WithTimeout(context.Background(), c.timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// setWatching records whether the event stream is subscribed. Without the
+// event stream, every call to Containers lists the containers again.
+func (c *ContainerCache) setWatching(watching bool) {
+	c.mu.Lock()
+	c.watching = watching
+	c.invalidate()
+	c.mu.Unlock()
+}
+
+// invalidate takes the cache out of sync. It must be called with the lock
+// held.
+func (c *ContainerCache) invalidate() {
+	c.seq++
+	c.invalidated = c.seq
+	c.synced = false
+}
+
+// observe starts an observation of the containers and returns its seq. Every
+// observation must be done. It must be called with the lock held.
+func (c *ContainerCache) observe() uint64 {
+	c.seq++
+	c.pending++
+	return c.seq
+}
+
+// done ends an observation. It must be called with the lock held.
+func (c *ContainerCache) done() {
+	c.pending--
+	if c.pending == 0 && len(c.updated) > 0 {
+		c.updated = map[string]uint64{}
+	}
+}
+
+// record records an observation of a container started at seq. It returns
+// false if a newer observation was recorded since, in which case the
+// observation must be dropped. It must be called with the lock held.
+func (c *ContainerCache) record(id string, seq uint64) bool {
+	if seq < c.resynced || seq < c.updated[id] {
+		return false
+	}
+	c.updated[id] = seq
+	delete(c.containers, id)
+	delete(c.excluded, id)
+	return true
+}
+
+// start records the use of the cache and starts watching the event stream if
+// it isn't watched.
+func (c *ContainerCache) start() {
+	c.startMu.Lock()
+	defer c.startMu.Unlock()
+	c.lastUsed = time.Now()
+	if c.stop != nil {
+		return
+	}
+
+	events := c.subscribe()
+	if events != nil {
+		c.setWatching(true)
+	}
+	c.stop = make(chan struct{})
+	c.stopped = make(chan struct{})
+	go c.watch(events, c.stop, c.stopped)
+}
+
+// Close stops watching the event stream and removes the listener from the
+// Docker events. A later call to Containers watches the event stream again.
+func (c *ContainerCache) Close() error {
+	c.startMu.Lock()
+	defer c.startMu.Unlock()
+	c.stopWatching()
+	return nil
+}
+
+// closeIfIdle stops watching the event stream if the cache wasn't used for
+// its idle timeout.
+func (c *ContainerCache) closeIfIdle() {
+	c.startMu.Lock()
+	defer c.startMu.Unlock()
+	if time.Since(c.lastUsed) >= c.idleTimeout {
+		logp.Debug("nvidiadocker", "the containers weren't requested for %v, stop watching the Docker events", c.idleTimeout)
+		c.stopWatching()
+	}
+}
+
+// stopWatching stops the watch of the event stream and waits for it to
+// return. It must be called with startMu held.
+func (c *ContainerCache) stopWatching() {
+	if c.stop == nil {
+		return
+	}
+	close(c.stop)
+	<-c.stopped
+	c.stop, c.stopped = nil, nil
+}
+
+// subscribe adds a new listener to the Docker events. It returns nil if the
+// event stream can't be subscribed.
+func (c *ContainerCache) subscribe() chan *docker.APIEvents {
+	events := make(chan *docker.APIEvents, containerEventsBufferSize)
+	if err := c.client.AddEventListener(events); err != nil {
+		logp.Warn("nvidiadocker: failed to listen to the Docker events: %v", err)
+		return nil
+	}
+	return events
+}
+
+// unsubscribe removes the listener from the Docker events. The client holds
+// its listeners while it sends an event, so the events are drained until the
+// listener is removed.
+func (c *ContainerCache) unsubscribe(events chan *docker.APIEvents) {
+	removed := make(chan struct{})
+	go func() {
+		if err := c.client.RemoveEventListener(events); err != nil {
+			logp.Debug("nvidiadocker", "failed to remove the Docker event listener: %v", err)
+		}
+		close(removed)
+	}()
+	for {
+		select {
+		case <-events:
+		case <-removed:
+			return
+		}
+	}
+}
+
+// watch applies the Docker events to the cache until stop is closed. The
+// client closes the listener when the event stream is lost, in which case
+// events may have been missed, so the cache is invalidated and the stream is
+// subscribed again.
+func (c *ContainerCache) watch(events chan *docker.APIEvents, stop <-chan struct{}, stopped chan<- struct{}) {
+	defer close(stopped)
+
+	var idle <-chan time.Time
+	if c.idleTimeout > 0 {
+		ticker := time.NewTicker(c.idleTimeout)
+		defer ticker.Stop()
+		idle = ticker.C
+	}
+	var retry <-chan time.Time
+	if events == nil {
+		retry = time.After(c.retryWait)
+	}
+
+	for {
+		select {
+		case event, ok := <-events:
+			if ok {
+				c.handleEvent(event)
+				continue
+			}
+			events = nil
+			c.setWatching(false)
+			logp.Warn("nvidiadocker: lost the Docker event stream, the containers are listed again")
+			retry = time.After(c.retryWait)
+		case <-retry:
+			if events = c.subscribe(); events != nil {
+				c.setWatching(true)
+				retry = nil
+			} else {
+				retry = time.After(c.retryWait)
+			}
+		case <-idle:
+			// closeIfIdle waits for the watch to return.
+			go c.closeIfIdle()
+		case <-stop:
+			if events != nil {
+				c.unsubscribe(events)
+			}
+			c.setWatching(false)
+			return
+		}
+	}
+}
+
+func (c *ContainerCache) handleEvent(event *docker.APIEvents) {
+	if event.Type != "container" {
+		return
+	}
+
+	id := event.Actor.ID
+	if id == "" {
+		id = event.ID
+	}
+
+	switch event.Action {
+	case "start", "rename", "update", "die", "destroy":
+		// The client delivers each event in its own goroutine, so the events
+		// of a container may arrive out of order, e.g. the die of a restart
+		// after its start. The container is inspected again instead of
+		// trusting the action, so the cache keeps its current state.
+		c.mu.Lock()
+		seq := c.observe()
+		c.mu.Unlock()
+
+		ctx, cancel := c.requestContext()
+		container, err := c.client.InspectContainerWithContext(id, ctx)
+		cancel()
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		defer c.done()
+		if _, removed := err.(*docker.NoSuchContainer); removed {
+			c.record(id, seq)
+			return
+		}
+		if err != nil {
+			// The containers are listed again on the next call, which
+			// reports the container if it still can't be inspected.
+			logp.Warn("nvidiadocker: failed to inspect the container %s after a %s event: %v", id, event.Action, err)
+			c.invalidate()
+			return
+		}
+
+		if c.record(id, seq) && container.State.Running {
+			if c.matchContainer(container) {
+				c.containers[id] = container
+			} else {
+				c.excluded[id] = true
+			}
+		}
+	}
+}
+
+// ExcludedIDs returns the IDs of the running containers which don't match
+// the filter and aren't returned by Containers.
+func (c *ContainerCache) ExcludedIDs() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ids := make([]string, 0, len(c.excluded))
+	for id := range c.excluded {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// matchContainer returns true if an inspected container matches the filter.
+func (c *ContainerCache) matchContainer(container *docker.Container) bool {
+	var (
+		image  string
+		labels map[string]string
+	)
+	if container.Config != nil {
+		image = container.Config.Image
+		labels = container.Config.Labels
+	}
+	return c.filter.Match(container.Name, image, labels)
+}
+
+// apiContainerName returns the name of a listed container. The names also
+// contain the links to the container, `/<other>/<alias>`, so the name is the
+// one without a further slash.
+func apiContainerName(apiContainer docker.APIContainers) string {
+	for _, name := range apiContainer.Names {
+		if !strings.Contains(strings.TrimPrefix(name, "/"), "/") {
+			return name
+		}
+	}
+	return ""
+}
+
+// containersByCreated sorts containers newest first, like `docker ps`.
+type containersByCreated []*docker.Container
+
+func (c containersByCreated) Len() int      { return len(c) }
+func (c containersByCreated) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c containersByCreated) Less(i, j int) bool {
+	if c[i].Created.Equal(c[j].Created) {
+		return c[i].ID < c[j].ID
+	}
+	return c[i].Created.After(c[j].Created)
+}
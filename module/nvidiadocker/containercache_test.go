@@ -0,0 +1,535 @@
+package nvidiadocker
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	docker "github.com/fpgeek/go-dockerclient"
+)
+
+type fakeContainerClient struct {
+	mu         sync.Mutex
+	containers map[string]*docker.Container
+	listCalls  int
+	created    int64
+	listeners  []chan<- *docker.APIEvents
+	// hanging are the containers whose inspection blocks until it is
+	// canceled.
+	hanging map[string]bool
+	// failing are the containers whose inspection fails.
+	failing map[string]error
+	// gate, if set, holds every list and inspect after its answer is taken
+	// until it is closed. The call is sent to entered first.
+	gate    chan struct{}
+	entered chan string
+}
+
+func (c *fakeContainerClient) ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
+	c.mu.Lock()
+	c.listCalls++
+	var apiContainers []docker.APIContainers
+	for id, container := range c.containers {
+		apiContainer := docker.APIContainers{ID: id, Names: []string{container.Name}}
+		if container.Config != nil {
+			apiContainer.Image = container.Config.Image
+			apiContainer.Labels = container.Config.Labels
+		}
+		apiContainers = append(apiContainers, apiContainer)
+	}
+	c.mu.Unlock()
+
+	c.wait("list")
+	return apiContainers, nil
+}
+
+// wait holds a call while the gate is set.
+func (c *fakeContainerClient) wait(call string) {
+	c.mu.Lock()
+	gate, entered := c.gate, c.entered
+	c.mu.Unlock()
+	if gate != nil {
+		entered <- call
+		<-gate
+	}
+}
+
+func (c *fakeContainerClient) setGate(gate chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gate = gate
+	c.entered = make(chan string, 10)
+}
+
+func (c *fakeContainerClient) InspectContainerWithContext(id string, ctx context.Context) (*docker.Container, error) {
+	c.mu.Lock()
+	hanging := c.hanging[id]
+	c.mu.Unlock()
+	if hanging {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	c.mu.Lock()
+	err := c.failing[id]
+	container, found := c.containers[id]
+	c.mu.Unlock()
+
+	c.wait("inspect " + id)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, &docker.NoSuchContainer{ID: id}
+	}
+	return container, nil
+}
+
+func (c *fakeContainerClient) AddEventListener(listener chan<- *docker.APIEvents) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.listeners = append(c.listeners, listener)
+	return nil
+}
+
+func (c *fakeContainerClient) RemoveEventListener(listener chan *docker.APIEvents) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, l := range c.listeners {
+		if l == listener {
+			c.listeners = append(c.listeners[:i], c.listeners[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (c *fakeContainerClient) setContainer(id string, running bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.created++
+	c.containers[id] = &docker.Container{
+		ID:      id,
+		Name:    "/" + id,
+		State:   docker.State{Running: running},
+		Created: time.Unix(c.created, 0),
+	}
+}
+
+func (c *fakeContainerClient) setContainerConfig(id string, image string, labels map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.containers[id].Config = &docker.Config{Image: image, Labels: labels}
+}
+
+func (c *fakeContainerClient) removeContainer(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.containers, id)
+}
+
+func (c *fakeContainerClient) listener() chan<- *docker.APIEvents {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.listeners[len(c.listeners)-1]
+}
+
+func (c *fakeContainerClient) listenerCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.listeners)
+}
+
+func (c *fakeContainerClient) listCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.listCalls
+}
+
+func waitForContainerIDs(t *testing.T, cache *ContainerCache, expected ...string) {
+	deadline := time.Now().Add(5 * time.Second)
+	var ids []string
+	for time.Now().Before(deadline) {
+		containers, err := cache.Containers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = ids[:0]
+		for _, container := range containers {
+			ids = append(ids, container.ID)
+		}
+		if equalStrings(ids, expected) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected containers %v, got %v", expected, ids)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func containerEvent(action, id string) *docker.APIEvents {
+	return &docker.APIEvents{Type: "container", Action: action, Actor: docker.APIActor{ID: id}}
+}
+
+func TestContainerCache(t *testing.T) {
+	client := &fakeContainerClient{containers: map[string]*docker.Container{}}
+	client.setContainer("a", true)
+	client.setContainer("b", true)
+
+	cache := NewContainerCache(client, nil, DefaultInspectWorkers, 0, 0)
+	cache.retryWait = time.Millisecond
+
+	waitForContainerIDs(t, cache, "b", "a")
+	waitForContainerIDs(t, cache, "b", "a")
+	if count := client.listCount(); count != 1 {
+		t.Fatalf("expected the containers to be listed once, got %d", count)
+	}
+
+	client.setContainer("c", true)
+	client.listener() <- containerEvent("start", "c")
+	waitForContainerIDs(t, cache, "c", "b", "a")
+
+	client.setContainer("a", false)
+	client.listener() <- containerEvent("die", "a")
+	waitForContainerIDs(t, cache, "c", "b")
+
+	client.listener() <- &docker.APIEvents{Type: "image", Action: "delete", Actor: docker.APIActor{ID: "b"}}
+	client.removeContainer("a")
+	client.removeContainer("b")
+	client.listener() <- containerEvent("destroy", "b")
+	waitForContainerIDs(t, cache, "c")
+
+	if count := client.listCount(); count != 1 {
+		t.Fatalf("expected the containers to be listed once, got %d", count)
+	}
+
+	// A container started while the event stream is lost shows up after
+	// the resync.
+	client.setContainer("d", true)
+	close(client.listener())
+	waitForContainerIDs(t, cache, "d", "c")
+	if count := client.listCount(); count < 2 {
+		t.Fatalf("expected the containers to be listed again, got %d", count)
+	}
+}
+
+func TestContainerCacheConcurrentEvents(t *testing.T) {
+	client := &fakeContainerClient{containers: map[string]*docker.Container{}}
+	client.setContainer("a", true)
+	client.setContainer("b", true)
+	cache := NewContainerCache(client, nil, DefaultInspectWorkers, 0, 0)
+
+	cachedIDs := func() []string {
+		cache.mu.RLock()
+		defer cache.mu.RUnlock()
+		containers := make([]*docker.Container, 0, len(cache.containers))
+		for _, container := range cache.containers {
+			containers = append(containers, container)
+		}
+		sort.Sort(containersByCreated(containers))
+		ids := make([]string, 0, len(containers))
+		for _, container := range containers {
+			ids = append(ids, container.ID)
+		}
+		return ids
+	}
+	handled := func(event *docker.APIEvents) chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			cache.handleEvent(event)
+			close(done)
+		}()
+		return done
+	}
+
+	// An event observed while the containers are listed isn't undone by the
+	// list taken before the event.
+	gate := make(chan struct{})
+	client.setGate(gate)
+	resynced := make(chan error)
+	go func() { resynced <- cache.resync() }()
+	<-client.entered
+	client.setContainer("a", false)
+	died := handled(containerEvent("die", "a"))
+	<-client.entered
+	close(gate)
+	<-died
+	if err := <-resynced; err != nil {
+		t.Fatal(err)
+	}
+	if ids := cachedIDs(); !equalStrings(ids, []string{"b"}) {
+		t.Fatalf("expected the stopped container to stay removed, got %v", ids)
+	}
+
+	// An inspect which started before the container was destroyed doesn't
+	// add it again.
+	gate = make(chan struct{})
+	client.setGate(gate)
+	client.setContainer("c", true)
+	started := handled(containerEvent("start", "c"))
+	<-client.entered
+	client.removeContainer("c")
+	destroyed := handled(containerEvent("destroy", "c"))
+	<-client.entered
+	close(gate)
+	<-started
+	<-destroyed
+	if ids := cachedIDs(); !equalStrings(ids, []string{"b"}) {
+		t.Fatalf("expected the destroyed container to stay removed, got %v", ids)
+	}
+	if len(cache.updated) != 0 {
+		t.Fatalf("expected no observation to be kept, got %v", cache.updated)
+	}
+
+	// The die of a restart delivered after its start doesn't drop the
+	// running container.
+	client.setGate(nil)
+	cache.handleEvent(containerEvent("start", "b"))
+	cache.handleEvent(containerEvent("die", "b"))
+	if ids := cachedIDs(); !equalStrings(ids, []string{"b"}) {
+		t.Fatalf("expected the restarted container to be kept, got %v", ids)
+	}
+}
+
+func TestContainerCacheClose(t *testing.T) {
+	client := &fakeContainerClient{containers: map[string]*docker.Container{}}
+	client.setContainer("a", true)
+
+	cache := NewContainerCache(client, nil, DefaultInspectWorkers, 0, 0)
+	waitForContainerIDs(t, cache, "a")
+	if count := client.listenerCount(); count != 1 {
+		t.Fatalf("expected a listener, got %d", count)
+	}
+
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if count := client.listenerCount(); count != 0 {
+		t.Fatalf("expected the listener to be removed, got %d", count)
+	}
+
+	// The cache watches the events again and lists the containers it may
+	// have missed.
+	client.setContainer("b", true)
+	waitForContainerIDs(t, cache, "b", "a")
+	if count := client.listenerCount(); count != 1 {
+		t.Fatalf("expected a listener, got %d", count)
+	}
+	cache.Close()
+
+	// An unused cache stops watching the events by itself.
+	cache = NewContainerCache(client, nil, DefaultInspectWorkers, 0, 20*time.Millisecond)
+	waitForContainerIDs(t, cache, "b", "a")
+	deadline := time.Now().Add(5 * time.Second)
+	for client.listenerCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the idle cache to remove its listener")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestContainerCacheFilter(t *testing.T) {
+	client := &fakeContainerClient{
+		containers: map[string]*docker.Container{},
+		// Inspecting a filtered container would block until the timeout.
+		hanging: map[string]bool{"cpu": true},
+	}
+	client.setContainer("gpu", true)
+	client.setContainerConfig("gpu", "nvidia/cuda:11.0", map[string]string{"team": "ml"})
+	client.setContainer("cpu", true)
+	client.setContainerConfig("cpu", "nginx:1.13", map[string]string{"team": "ml"})
+
+	filter, err := NewContainerFilter(Config{
+		IncludeLabels: []string{"team=ml"},
+		ExcludeImages: []string{"nginx"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewContainerCache(client, filter, DefaultInspectWorkers, time.Second, 0)
+	cache.retryWait = time.Millisecond
+
+	waitForContainerIDs(t, cache, "gpu")
+	if excluded := cache.ExcludedIDs(); !equalStrings(excluded, []string{"cpu"}) {
+		t.Fatalf("expected cpu to be excluded, got %v", excluded)
+	}
+
+	// Started containers are filtered after they are inspected.
+	client.setContainer("web", true)
+	client.setContainerConfig("web", "nginx", map[string]string{"team": "ml"})
+	client.listener() <- containerEvent("start", "web")
+	client.setContainer("train", true)
+	client.setContainerConfig("train", "nvidia/cuda@sha256:1234", map[string]string{"team": "ml"})
+	client.listener() <- containerEvent("start", "train")
+	waitForContainerIDs(t, cache, "train", "gpu")
+	if excluded := cache.ExcludedIDs(); !equalStrings(excluded, []string{"cpu", "web"}) {
+		t.Fatalf("expected cpu and web to be excluded, got %v", excluded)
+	}
+
+	client.setContainer("web", false)
+	client.listener() <- containerEvent("die", "web")
+	deadline := time.Now().Add(5 * time.Second)
+	for !equalStrings(cache.ExcludedIDs(), []string{"cpu"}) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected web to be forgotten, got %v", cache.ExcludedIDs())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestContainerCacheTimeout(t *testing.T) {
+	client := &fakeContainerClient{
+		containers: map[string]*docker.Container{},
+		hanging:    map[string]bool{"b": true},
+	}
+	client.setContainer("a", true)
+	client.setContainer("b", true)
+	client.setContainer("c", true)
+
+	cache := NewContainerCache(client, nil, 2, 50*time.Millisecond, 0)
+	cache.retryWait = time.Millisecond
+
+	containers, err := cache.Containers()
+	inspectErr, ok := err.(*InspectError)
+	if !ok {
+		t.Fatalf("expected an inspect timeout, got %v", err)
+	}
+	if !equalStrings(inspectErr.TimedOut, []string{"b"}) || len(inspectErr.Failed) != 0 {
+		t.Fatalf("expected b to time out, got %v", inspectErr)
+	}
+	if len(containers) != 2 || containers[0].ID != "c" || containers[1].ID != "a" {
+		t.Fatalf("expected the containers inspected in time, got %v", containers)
+	}
+
+	// The containers are listed again until all are inspected.
+	client.mu.Lock()
+	client.hanging = nil
+	client.mu.Unlock()
+	waitForContainerIDs(t, cache, "c", "b", "a")
+	if count := client.listCount(); count != 2 {
+		t.Fatalf("expected the containers to be listed again once, got %d", count)
+	}
+}
+
+func TestContainerCacheInspectFailure(t *testing.T) {
+	client := &fakeContainerClient{
+		containers: map[string]*docker.Container{},
+		failing:    map[string]error{"b": errors.New("json: cannot unmarshal string into Go value of type int")},
+	}
+	client.setContainer("a", true)
+	client.setContainer("b", true)
+
+	cache := NewContainerCache(client, nil, DefaultInspectWorkers, time.Second, 0)
+	cache.retryWait = time.Millisecond
+
+	containers, err := cache.Containers()
+	inspectErr, ok := err.(*InspectError)
+	if !ok {
+		t.Fatalf("expected an inspect failure, got %v", err)
+	}
+	if len(inspectErr.Failed) != 1 || inspectErr.Failed[0].ID != "b" || inspectErr.Failed[0].Name != "b" {
+		t.Fatalf("expected b to fail, got %v", inspectErr)
+	}
+	if len(containers) != 1 || containers[0].ID != "a" {
+		t.Fatalf("expected the other containers, got %v", containers)
+	}
+
+	// The containers are listed again until all are inspected.
+	client.mu.Lock()
+	client.failing = nil
+	client.mu.Unlock()
+	waitForContainerIDs(t, cache, "b", "a")
+
+	// A started container which can't be inspected is reported by the next
+	// call.
+	client.setContainer("c", true)
+	client.mu.Lock()
+	client.failing = map[string]error{"c": errors.New("connection reset by peer")}
+	client.mu.Unlock()
+	client.listener() <- containerEvent("start", "c")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := cache.Containers()
+		if inspectErr, ok := err.(*InspectError); ok && len(inspectErr.Failed) == 1 && inspectErr.Failed[0].ID == "c" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected c to be reported, got %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInspectContainersWorkers(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		running int
+		maxSeen int
+	)
+	client := inspectorFunc(func(id string, ctx context.Context) (*docker.Container, error) {
+		mu.Lock()
+		running++
+		if running > maxSeen {
+			maxSeen = running
+		}
+		mu.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		switch id {
+		case "gone":
+			return nil, &docker.NoSuchContainer{ID: id}
+		case "broken":
+			return nil, errors.New("unexpected EOF")
+		}
+		return &docker.Container{ID: id}, nil
+	})
+
+	var apiContainers []docker.APIContainers
+	for _, id := range []string{"a", "b", "gone", "c", "broken", "d", "e"} {
+		apiContainers = append(apiContainers, docker.APIContainers{ID: id, Names: []string{"/" + id}})
+	}
+
+	containers, err := InspectContainers(context.Background(), client, apiContainers, 3)
+	inspectErr, ok := err.(*InspectError)
+	if !ok || len(inspectErr.TimedOut) != 0 || !equalStrings(inspectErr.FailedIDs(), []string{"broken"}) {
+		t.Fatalf("expected only broken to fail, got %v", err)
+	}
+	if inspectErr.Failed[0].Name != "broken" {
+		t.Fatalf("expected the name of the failed container, got %s", inspectErr.Failed[0].Name)
+	}
+	var ids []string
+	for _, container := range containers {
+		ids = append(ids, container.ID)
+	}
+	if !equalStrings(ids, []string{"a", "b", "c", "d", "e"}) {
+		t.Fatalf("expected the inspected containers in list order, got %v", ids)
+	}
+	if maxSeen > 3 {
+		t.Fatalf("expected up to 3 inspections at a time, got %d", maxSeen)
+	}
+}
+
+type inspectorFunc func(id string, ctx context.Context) (*docker.Container, error)
+
+func (f inspectorFunc) InspectContainerWithContext(id string, ctx context.Context) (*docker.Container, error) {
+	return f(id, ctx)
+}
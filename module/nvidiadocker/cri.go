@@ -0,0 +1,267 @@
+package nvidiadocker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+const (
+	// DefaultCRIEndpoint is the CRI socket of containerd.
+	DefaultCRIEndpoint = "unix:///run/containerd/containerd.sock"
+	// DefaultCrictlPath is the crictl the cri runtime talks to the CRI
+	// socket with.
+	DefaultCrictlPath = "crictl"
+
+	criRequestTimeout = 10 * time.Second
+)
+
+// errCRIContainerNotFound is returned for containers removed since they were
+// listed.
+var errCRIContainerNotFound = errors.New("container not found")
+
+// criRuntime lists the containers of a CRI runtime like containerd or CRI-O
+// with crictl, as the gRPC client of the CRI doesn't build with the Go this
+// beat is built with. The CRI doesn't expose the environment of a container,
+// so it is read from the OCI runtime spec in the verbose container status.
+type criRuntime struct {
+	crictl  *crictlCommand
+	filter  *ContainerFilter
+	workers int
+	timeout time.Duration
+
+	mu       sync.Mutex
+	excluded []string
+}
+
+// crictlContainers is the output of `crictl ps -o json`. Timestamps are
+// int64s, which the CRI's JSON encoding writes as strings.
+type crictlContainers struct {
+	Containers []struct {
+		ID       string `json:"id"`
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+		Image struct {
+			Image string `json:"image"`
+		} `json:"image"`
+		CreatedAt json.Number       `json:"createdAt"`
+		Labels    map[string]string `json:"labels"`
+	} `json:"containers"`
+}
+
+// crictlContainerStatus is the output of `crictl inspect -o json`, with the
+// verbose container status info of containerd and CRI-O under info.
+type crictlContainerStatus struct {
+	Info *criContainerInfo `json:"info"`
+}
+
+// criContainerInfo is the part of the verbose container status info of
+// containerd and CRI-O used to attribute GPUs.
+type criContainerInfo struct {
+	RuntimeSpec struct {
+		Process *struct {
+			Env []string `json:"env"`
+		} `json:"process"`
+		Linux *struct {
+			Devices []struct {
+				Path string `json:"path"`
+			} `json:"devices"`
+		} `json:"linux"`
+	} `json:"runtimeSpec"`
+}
+
+// newCRIRuntime returns the runtime of the configured CRI socket, which only
+// returns the containers matching the filter. Up to inspectworkers container
+// statuses are requested at a time, and listing the containers and requesting
+// their statuses is given up after the fetch timeout.
+func newCRIRuntime(cfg Config, filter *ContainerFilter) (*criRuntime, error) {
+	if cfg.CRIEndpoint == "" {
+		return nil, fmt.Errorf("criendpoint is required by the cri runtime")
+	}
+
+	timeout := cfg.fetchTimeout()
+	if timeout <= 0 {
+		timeout = criRequestTimeout
+	}
+	return &criRuntime{
+		crictl:  newCrictlCommand(cfg),
+		filter:  filter,
+		workers: cfg.InspectWorkers,
+		timeout: timeout,
+	}, nil
+}
+
+func (r *criRuntime) Containers() ([]*Container, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	output, err := r.crictl.run(ctx, "ps", "--state", "running", "-o", "json")
+	if err != nil {
+		return nil, err
+	}
+	var list crictlContainers
+	if err := json.Unmarshal(output, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse the containers listed by crictl: %v", err)
+	}
+
+	// The containers are filtered before their status is requested, as the
+	// list has their names, images and labels. All containers are listed, so
+	// the excluded ones are known.
+	var (
+		containers = make([]*Container, 0, len(list.Containers))
+		excluded   []string
+	)
+	for _, criContainer := range list.Containers {
+		if !r.filter.Match(criContainer.Metadata.Name, criContainer.Image.Image, criContainer.Labels) {
+			excluded = append(excluded, criContainer.ID)
+			continue
+		}
+
+		container := &Container{
+			ID:     criContainer.ID,
+			Name:   criContainer.Metadata.Name,
+			Labels: criContainer.Labels,
+			Image:  criContainer.Image.Image,
+		}
+		if createdAt, err := strconv.ParseInt(string(criContainer.CreatedAt), 10, 64); err == nil {
+			container.Created = time.Unix(0, createdAt)
+		}
+		containers = append(containers, container)
+	}
+	r.mu.Lock()
+	r.excluded = excluded
+	r.mu.Unlock()
+
+	results, errs, timedOut := inspectConcurrently(ctx, len(containers), r.workers, func(ctx context.Context, i int) (interface{}, error) {
+		err := r.inspect(ctx, containers[i])
+		if err == errCRIContainerNotFound {
+			return nil, nil
+		}
+		return containers[i], err
+	})
+
+	var (
+		inspected = make([]*Container, 0, len(containers))
+		failed    []ContainerError
+	)
+	for i, result := range results {
+		if errs[i] != nil {
+			failed = append(failed, ContainerError{
+				ID:   containers[i].ID,
+				Name: containers[i].Name,
+				Err:  errs[i],
+			})
+		} else if result != nil {
+			inspected = append(inspected, result.(*Container))
+		}
+	}
+
+	var timedOutIDs []string
+	for _, i := range timedOut {
+		timedOutIDs = append(timedOutIDs, containers[i].ID)
+	}
+	return inspected, newInspectError(timedOutIDs, failed)
+}
+
+func (r *criRuntime) ExcludedContainerIDs() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.excluded
+}
+
+// inspect sets the environment and device nodes of the container from its
+// verbose status. Containers removed in the meantime are skipped by the
+// caller, the others which can't be inspected are reported.
+func (r *criRuntime) inspect(ctx context.Context, container *Container) error {
+	output, err := r.crictl.run(ctx, "inspect", "-o", "json", container.ID)
+	if err != nil {
+		logp.Debug("nvidiadocker", "failed to get the status of container %s: %v", container.ID, err)
+		return err
+	}
+
+	if err := setCRIContainerInfo(container, output); err != nil {
+		logp.Warn("nvidiadocker: failed to parse the runtime spec of container %s: %v", container.ID, err)
+	}
+	return nil
+}
+
+// setCRIContainerInfo sets the environment and device nodes of the container
+// from the OCI runtime spec in the verbose container status.
+func setCRIContainerInfo(container *Container, output []byte) error {
+	var status crictlContainerStatus
+	if err := json.Unmarshal(output, &status); err != nil {
+		return err
+	}
+	if status.Info == nil {
+		return nil
+	}
+
+	if process := status.Info.RuntimeSpec.Process; process != nil {
+		container.Env = process.Env
+	}
+	if linux := status.Info.RuntimeSpec.Linux; linux != nil {
+		for _, device := range linux.Devices {
+			container.DevicePaths = append(container.DevicePaths, device.Path)
+		}
+	}
+	return nil
+}
+
+// crictlCommand runs crictl against the CRI socket, optionally through a
+// wrapper like `chroot /host`.
+type crictlCommand struct {
+	path     string
+	wrapper  []string
+	endpoint string
+}
+
+func newCrictlCommand(cfg Config) *crictlCommand {
+	path := cfg.CrictlPath
+	if path == "" {
+		path = DefaultCrictlPath
+	}
+	return &crictlCommand{
+		path:     path,
+		wrapper:  cfg.CrictlWrapper,
+		endpoint: cfg.CRIEndpoint,
+	}
+}
+
+// run runs crictl with the given arguments and returns its output, or
+// errCRIContainerNotFound if the CRI runtime doesn't know the container.
+func (c *crictlCommand) run(ctx context.Context, args ...string) ([]byte, error) {
+	commandLine := make([]string, 0, len(c.wrapper)+3+len(args))
+	commandLine = append(commandLine, c.wrapper...)
+	commandLine = append(commandLine, c.path, "--runtime-endpoint", c.endpoint)
+	commandLine = append(commandLine, args...)
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, commandLine[0], commandLine[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("%s timed out", c.path)
+		}
+		message := strings.TrimSpace(stderr.String())
+		if strings.Contains(message, "code = NotFound") {
+			return nil, errCRIContainerNotFound
+		}
+		if message != "" {
+			return nil, fmt.Errorf("%s failed: %v: %s", c.path, err, message)
+		}
+		return nil, fmt.Errorf("%s failed: %v", c.path, err)
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,111 @@
+package nvidiadocker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testCrictlScript is a fake crictl serving the containers and their verbose
+// statuses like crictl does against containerd. It logs its arguments.
+const testCrictlScript = `#!/bin/sh
+dir=$(dirname "$0")
+echo "$*" >> "$dir/args"
+shift 2
+case "$1" in
+ps)
+	cat "$dir/ps.json"
+	;;
+inspect)
+	if [ -f "$dir/$4.json" ]; then
+		cat "$dir/$4.json"
+	elif [ "$4" = "d3b07384d113" ]; then
+		echo "getting the status of the container \"$4\": rpc error: code = Internal desc = failed to read the container spec" >&2
+		exit 1
+	else
+		echo "getting the status of the container \"$4\": rpc error: code = NotFound desc = an error occurred when try to find container \"$4\": not found" >&2
+		exit 1
+	fi
+	;;
+esac
+`
+
+func TestCRIRuntimeContainers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cri")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"crictl": testCrictlScript,
+		"ps.json": `{"containers":[` +
+			`{"id":"4e3bb646c7ff","metadata":{"name":"trainer","attempt":0},"image":{"image":"nvidia/cuda"},"createdAt":"1500000000000000000",` +
+			`"labels":{"io.kubernetes.container.name":"trainer","io.kubernetes.pod.uid":"535c289c-6dd8-e308-b4ca-524b0fc07fa6"}},` +
+			`{"id":"ca766152aa55","metadata":{"name":"removed"},"image":{"image":"busybox"},"createdAt":"0"},` +
+			`{"id":"d3b07384d113","metadata":{"name":"unreadable"},"image":{"image":"busybox"},"createdAt":"0"}]}`,
+		"4e3bb646c7ff.json": `{"status":{"id":"4e3bb646c7ff"},"info":{"sandboxID":"149648d87e32","pid":4242,"runtimeSpec":{` +
+			`"process":{"env":["PATH=/usr/bin","NVIDIA_VISIBLE_DEVICES=GPU-535c289c-6dd8-e308-b4ca-524b0fc07fa6"]},` +
+			`"linux":{"devices":[{"path":"/dev/nvidiactl","type":"c","major":195,"minor":255},{"path":"/dev/nvidia2","type":"c","major":195,"minor":2}]}}}}`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := DefaultConfig()
+	cfg.CrictlPath = filepath.Join(dir, "crictl")
+	runtime, err := newCRIRuntime(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	containers, err := runtime.Containers()
+	inspectErr, ok := err.(*InspectError)
+	if !ok || len(inspectErr.Failed) != 1 || inspectErr.Failed[0].ID != "d3b07384d113" || inspectErr.Failed[0].Name != "unreadable" {
+		t.Fatalf("expected the unreadable container to be reported, got %v", err)
+	}
+	if !strings.Contains(inspectErr.Failed[0].Err.Error(), "failed to read the container spec") {
+		t.Fatalf("expected the error to include what crictl reported, got %v", inspectErr.Failed[0].Err)
+	}
+
+	if len(containers) != 1 {
+		t.Fatalf("expected the removed and unreadable containers to be skipped, got %d containers", len(containers))
+	}
+	container := containers[0]
+	if container.ID != "4e3bb646c7ff" || container.Name != "trainer" || container.Image != "nvidia/cuda" {
+		t.Fatalf("unexpected container %s %s %s", container.ID, container.Name, container.Image)
+	}
+	if !reflect.DeepEqual(container.Env, []string{"PATH=/usr/bin", "NVIDIA_VISIBLE_DEVICES=GPU-535c289c-6dd8-e308-b4ca-524b0fc07fa6"}) {
+		t.Fatalf("unexpected env %v", container.Env)
+	}
+	if !reflect.DeepEqual(container.DevicePaths, []string{"/dev/nvidiactl", "/dev/nvidia2"}) {
+		t.Fatalf("unexpected device paths %v", container.DevicePaths)
+	}
+	if container.Labels["io.kubernetes.container.name"] != "trainer" {
+		t.Fatalf("unexpected labels %v", container.Labels)
+	}
+	if container.Created.UnixNano() != 1500000000000000000 {
+		t.Fatalf("unexpected creation time %v", container.Created)
+	}
+
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(args), "--runtime-endpoint "+DefaultCRIEndpoint+" ps --state running -o json\n") {
+		t.Fatalf("expected only running containers to be listed from the CRI socket, got %s", args)
+	}
+
+	assignments := GetGPUAssignments(container, testGPUDevices, nil)
+	expected := []GPUAssignment{
+		{Index: 1, Sources: []string{GPUSourceEnv, GPUSourceDeviceNode}},
+	}
+	if !reflect.DeepEqual(assignments, expected) {
+		t.Fatalf("expected %v, got %v", expected, assignments)
+	}
+}
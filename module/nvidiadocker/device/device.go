@@ -0,0 +1,195 @@
+package device
+
+import (
+	"strings"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/elastic/beats/metricbeat/mb"
+	"github.com/fpgeek/nvidiadockerbeat/module/nvidiadocker"
+)
+
+// init registers the MetricSet with the central registry.
+// The New method will be called after the setup of the module and before starting to fetch data
+func init() {
+	if err := mb.Registry.AddMetricSet("nvidiadocker", "device", New); err != nil {
+		panic(err)
+	}
+}
+
+// MetricSet reports the status of every GPU on the host together with the
+// containers the GPU is assigned to, so idle GPUs show up as well.
+type MetricSet struct {
+	mb.BaseMetricSet
+	containers    nvidiadocker.Runtime
+	deviceBackend nvidiadocker.DeviceStatusBackend
+	kubeletPath   string
+	exporter      *nvidiadocker.PrometheusExporter
+	hostName      string
+}
+
+// New create a new instance of the MetricSet
+func New(base mb.BaseMetricSet) (mb.MetricSet, error) {
+	cfg := nvidiadocker.DefaultConfig()
+	if err := base.Module().UnpackConfig(&cfg); err != nil {
+		return nil, err
+	}
+	cfg, err := nvidiadocker.HostConfig(cfg, base.Host())
+	if err != nil {
+		return nil, err
+	}
+
+	runtime, err := nvidiadocker.NewRuntime(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	deviceBackend, err := nvidiadocker.NewDeviceStatusBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	exporter, err := nvidiadocker.NewPrometheusExporter(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MetricSet{
+		BaseMetricSet: base,
+		containers:    runtime,
+		deviceBackend: deviceBackend,
+		kubeletPath:   cfg.KubeletCheckpoint,
+		exporter:      exporter,
+		hostName:      nvidiadocker.HostName(base.Host()),
+	}, nil
+}
+
+// Close releases the GPU status backend. It is only used by the tests, as
+// metricbeat doesn't close its metricsets.
+func (m *MetricSet) Close() error {
+	return nvidiadocker.CloseDeviceStatusBackend(m.deviceBackend)
+}
+
+// Fetch returns one event per GPU.
+func (m *MetricSet) Fetch() ([]common.MapStr, error) {
+	gpuDevices, err := m.deviceBackend.DeviceStatuses()
+	if err != nil {
+		return nil, err
+	}
+
+	containers, err := m.containers.Containers()
+	if _, partial := err.(*nvidiadocker.InspectError); partial {
+		logp.Warn("nvidiadocker: attributing the GPUs to the containers which were inspected: %v", err)
+	} else if err != nil {
+		return nil, err
+	}
+
+	kubeletAllocations, err := nvidiadocker.ReadKubeletCheckpoint(m.kubeletPath)
+	if err != nil {
+		logp.Warn("nvidiadocker: failed to read the kubelet checkpoint %s: %v", m.kubeletPath, err)
+	}
+
+	events := fetchFromDevices(gpuDevices, containers, kubeletAllocations)
+	if m.exporter != nil {
+		m.exporter.Update("device", m.hostName, prometheusSamples(events))
+	}
+	return nvidiadocker.TagHost(events, m.hostName), nil
+}
+
+func fetchFromDevices(gpuDevices []nvidiadocker.DeviceStatus, containers []*nvidiadocker.Container, kubeletAllocations nvidiadocker.KubeletAllocations) []common.MapStr {
+	assignedContainers := make(map[int][]*nvidiadocker.Container, len(gpuDevices))
+	for _, container := range containers {
+		if nvidiadocker.IsPodSandbox(container.Labels) {
+			continue
+		}
+		for _, deviceIndex := range nvidiadocker.GetGPUDeviceIndices(container, gpuDevices, kubeletAllocations) {
+			assignedContainers[deviceIndex] = append(assignedContainers[deviceIndex], container)
+		}
+	}
+
+	events := make([]common.MapStr, 0, len(gpuDevices))
+	for i, device := range gpuDevices {
+		deviceIndex := i
+		if device.Index != nil {
+			deviceIndex = int(*device.Index)
+		}
+
+		containerIDs := make([]string, 0, len(assignedContainers[deviceIndex]))
+		containerNames := make([]string, 0, len(assignedContainers[deviceIndex]))
+		for _, container := range assignedContainers[deviceIndex] {
+			containerIDs = append(containerIDs, container.ID)
+			containerNames = append(containerNames, container.Name)
+		}
+
+		event := common.MapStr{
+			"index":  deviceIndex,
+			"uuid":   device.UUID,
+			"name":   device.Name,
+			"pstate": device.PState,
+			"utilization": common.MapStr{
+				"gpu":              device.Utilization.GPU,
+				"memory":           device.Utilization.Memory,
+				"memorycontroller": device.Utilization.MemoryController,
+				"encoder":          device.Utilization.Encoder,
+				"decoder":          device.Utilization.Decoder,
+			},
+			"memory": common.MapStr{
+				"used": common.MapStr{
+					"bytes": device.Memory.Used,
+					"pct":   device.Memory.UsedPct,
+				},
+				"free": common.MapStr{
+					"bytes": device.Memory.Free,
+				},
+				"total": common.MapStr{
+					"bytes": device.Memory.Total,
+				},
+			},
+			"temperature": device.Temperature,
+			"fan": common.MapStr{
+				"speed": device.FanSpeed,
+			},
+			"power": common.MapStr{
+				"draw":  device.Power.Draw,
+				"limit": device.Power.Limit,
+			},
+			"clocks": common.MapStr{
+				"sm":     device.Clocks.Cores,
+				"memory": device.Clocks.Memory,
+			},
+			"ecc": common.MapStr{
+				"corrected":   device.ECCErrors.Corrected,
+				"uncorrected": device.ECCErrors.Uncorrected,
+			},
+			"pci": common.MapStr{
+				"busid": device.PCI.BusID,
+				"link": common.MapStr{
+					"gen":   device.PCI.LinkGen,
+					"width": device.PCI.LinkWidth,
+				},
+			},
+			"containers": common.MapStr{
+				"count": len(containerIDs),
+				"ids":   containerIDs,
+				"names": containerNames,
+			},
+		}
+
+		if len(device.Fields) > 0 {
+			query := common.MapStr{}
+			for name, field := range device.Fields {
+				query[strings.Replace(name, ".", "_", -1)] = common.MapStr{
+					"value": field.Value,
+					"unit":  field.Unit,
+				}
+			}
+			event["query"] = query
+		}
+		if len(device.InvalidFields) > 0 {
+			event["invalidfields"] = device.InvalidFields
+		}
+
+		events = append(events, event)
+	}
+	return events
+}
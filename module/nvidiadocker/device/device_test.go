@@ -0,0 +1,89 @@
+package device
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/fpgeek/nvidiadockerbeat/module/nvidiadocker"
+)
+
+func TestFetchFromDevices(t *testing.T) {
+	gpuDevices := []nvidiadocker.DeviceStatus{
+		{
+			Index:       toUintP(0),
+			UUID:        "GPU-66a2874a-837d-cd53-ab26-0d2d842d9822",
+			Temperature: 15,
+			Utilization: nvidiadocker.UtilizationInfo{
+				GPU:    10,
+				Memory: 50,
+			},
+			Memory: nvidiadocker.MemoryInfo{
+				Used:    11456 * 1024 * 1024,
+				Total:   22912 * 1024 * 1024,
+				UsedPct: 0.5,
+			},
+			Fields: map[string]nvidiadocker.QueryField{
+				"clocks.max.sm": {Value: float64(1531), Unit: "MHz"},
+			},
+		},
+		{
+			Index:         toUintP(1),
+			UUID:          "GPU-535c289c-6dd8-e308-b4ca-524b0fc07fa6",
+			InvalidFields: []string{"temperature.gpu"},
+		},
+	}
+
+	containers := []*nvidiadocker.Container{
+		{
+			ID:   "id1",
+			Name: "name1",
+			Env:  []string{"NVIDIA_VISIBLE_DEVICES=0"},
+		},
+		{
+			ID:   "id2",
+			Name: "name2",
+		},
+	}
+
+	events := fetchFromDevices(gpuDevices, containers, nil)
+	if len(events) != 2 {
+		t.Fatalf("expected one event per GPU, got %d", len(events))
+	}
+
+	busy, _ := events[0].GetValue("containers")
+	if !reflect.DeepEqual(busy, common.MapStr{
+		"count": 1,
+		"ids":   []string{"id1"},
+		"names": []string{"name1"},
+	}) {
+		t.Fatalf("unexpected containers of the busy GPU: %v", busy)
+	}
+
+	if uuid, _ := events[0].GetValue("uuid"); uuid != gpuDevices[0].UUID {
+		t.Fatalf("unexpected uuid: %v", uuid)
+	}
+
+	if usedPct, _ := events[0].GetValue("memory.used.pct"); usedPct != 0.5 {
+		t.Fatalf("unexpected used memory share: %v", usedPct)
+	}
+
+	if maxClock, _ := events[0].GetValue("query.clocks_max_sm.value"); maxClock != float64(1531) {
+		t.Fatalf("unexpected pass-through query field: %v", maxClock)
+	}
+
+	if count, _ := events[1].GetValue("containers.count"); count != 0 {
+		t.Fatalf("idle GPU must be reported without containers, got %v", count)
+	}
+
+	if _, err := events[0].GetValue("invalidfields"); err == nil {
+		t.Fatal("expected no invalid fields for the first GPU")
+	}
+	if invalid, _ := events[1].GetValue("invalidfields"); !reflect.DeepEqual(invalid, []string{"temperature.gpu"}) {
+		t.Fatalf("unexpected invalid fields: %v", invalid)
+	}
+}
+
+func toUintP(val uint) *uint {
+	return &val
+}
@@ -0,0 +1,37 @@
+package device
+
+import (
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/fpgeek/nvidiadockerbeat/module/nvidiadocker"
+)
+
+// prometheusDeviceMetrics are exported per GPU.
+var prometheusDeviceMetrics = []struct {
+	key  string
+	name string
+	help string
+}{
+	{"utilization.gpu", "nvidiadocker_gpu_utilization_percent", "GPU utilization."},
+	{"utilization.memory", "nvidiadocker_gpu_memory_utilization_percent", "Used share of the GPU memory."},
+	{"memory.used.bytes", "nvidiadocker_gpu_memory_used_bytes", "Used GPU memory."},
+	{"memory.free.bytes", "nvidiadocker_gpu_memory_free_bytes", "Free GPU memory."},
+	{"memory.total.bytes", "nvidiadocker_gpu_memory_total_bytes", "Total GPU memory."},
+	{"temperature", "nvidiadocker_gpu_temperature_celsius", "GPU temperature."},
+	{"power.draw", "nvidiadocker_gpu_power_draw_watts", "Power draw of the GPU."},
+	{"containers.count", "nvidiadocker_gpu_containers", "Number of containers the GPU is assigned to."},
+}
+
+// prometheusSamples returns the Prometheus samples of the GPU events.
+func prometheusSamples(events []common.MapStr) []nvidiadocker.PrometheusSample {
+	var samples []nvidiadocker.PrometheusSample
+	for _, event := range events {
+		uuid, _ := event["uuid"].(string)
+		labels := nvidiadocker.GPULabels(event["index"], uuid)
+		for _, metric := range prometheusDeviceMetrics {
+			if sample, ok := nvidiadocker.EventSample(event, metric.key, metric.name, metric.help, labels); ok {
+				samples = append(samples, sample)
+			}
+		}
+	}
+	return samples
+}
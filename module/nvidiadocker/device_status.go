@@ -0,0 +1,103 @@
+package nvidiadocker
+
+type NvidiaStatus struct {
+	Devices []DeviceStatus
+}
+
+// UtilizationInfo is the device utilization in percent. Memory is the used
+// share of the device memory, MemoryController the load of the memory
+// controller (nvidia-smi's utilization.memory).
+type UtilizationInfo struct {
+	GPU              uint
+	Memory           uint
+	MemoryController uint
+	Encoder          uint
+	Decoder          uint
+}
+
+const mebibyte = 1024 * 1024
+
+// MemoryInfo is the device memory in bytes. UsedPct is the used share of the
+// device memory between 0 and 1.
+type MemoryInfo struct {
+	Used    uint64
+	Free    uint64
+	Total   uint64
+	UsedPct float64
+}
+
+// setMemoryUsage derives the used share of the device memory from the used
+// and total memory.
+func setMemoryUsage(deviceStatus *DeviceStatus) {
+	if deviceStatus.Memory.Total == 0 {
+		return
+	}
+	deviceStatus.Memory.UsedPct = float64(deviceStatus.Memory.Used) / float64(deviceStatus.Memory.Total)
+	deviceStatus.Utilization.Memory = uint(deviceStatus.Memory.UsedPct * 100.0)
+}
+
+// PowerInfo is the power draw and the power limit in W.
+type PowerInfo struct {
+	Draw  float64
+	Limit float64
+}
+
+// ClockInfo is the current clock speed in MHz.
+type ClockInfo struct {
+	Cores  uint
+	Memory uint
+}
+
+// ECCErrorsInfo is the number of volatile ECC errors since the last driver reload.
+type ECCErrorsInfo struct {
+	Corrected   uint64
+	Uncorrected uint64
+}
+
+// PCIInfo holds the BAR1 memory in use (MiB), the PCIe throughput (MB/s)
+// and the current PCIe link generation and width.
+type PCIInfo struct {
+	BusID     string
+	BAR1Used  uint64
+	RX        uint
+	TX        uint
+	LinkGen   uint
+	LinkWidth uint
+}
+
+// ProcessInfo is a compute process running on a device, MemoryUsed is in MiB.
+type ProcessInfo struct {
+	PID        uint
+	Name       string
+	MemoryUsed uint64
+}
+
+// QueryField is a queried value without a typed DeviceStatus field, with the
+// unit reported by nvidia-smi.
+type QueryField struct {
+	Value interface{}
+	Unit  string
+}
+
+type DeviceStatus struct {
+	Index *uint
+	// MinorNumber is the N of the device node /dev/nvidiaN of the GPU, if
+	// known.
+	MinorNumber *uint
+	UUID        string
+	Name        string
+	Temperature uint
+	FanSpeed    uint
+	PState      string
+	Power       PowerInfo
+	Utilization UtilizationInfo
+	Memory      MemoryInfo
+	Clocks      ClockInfo
+	ECCErrors   ECCErrorsInfo
+	PCI         PCIInfo
+	Processes   []ProcessInfo
+	Fields      map[string]QueryField
+	// InvalidFields are the queried fields whose values couldn't be parsed
+	// and are left unset.
+	InvalidFields []string
+}
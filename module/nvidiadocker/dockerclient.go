@@ -0,0 +1,221 @@
+package nvidiadocker
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/elastic/beats/libbeat/logp"
+	docker "github.com/fpgeek/go-dockerclient"
+)
+
+const (
+	// DefaultDockerEndpoint is the socket of dockerd, used if neither
+	// dockerendpoint nor DOCKER_HOST is set.
+	DefaultDockerEndpoint = "unix:///var/run/docker.sock"
+
+	// DefaultDockerConnectTimeout is how long connecting to the daemon is
+	// tried.
+	DefaultDockerConnectTimeout = 30 * time.Second
+
+	// dockerMaxAPIVersion is the latest Docker API version the beat knows,
+	// GPU device requests were added in 1.40.
+	dockerMaxAPIVersion = "1.41"
+
+	verificationModeNone = "none"
+)
+
+// DockerTLSConfig is the TLS configuration of a tcp Docker endpoint, like the
+// ssl settings of the docker module of Metricbeat.
+type DockerTLSConfig struct {
+	Enabled                *bool    `config:"enabled"`
+	CertificateAuthorities []string `config:"certificate_authorities"`
+	// CertificateAuthority is the single certificate authority setting of the
+	// docker module, added to CertificateAuthorities.
+	CertificateAuthority string `config:"certificate_authority"`
+	Certificate          string `config:"certificate"`
+	Key                  string `config:"key"`
+	// VerificationMode is "full", the default, or "none" to skip verifying
+	// the certificate of the daemon.
+	VerificationMode string `config:"verification_mode"`
+}
+
+// IsEnabled returns true if TLS is configured and not disabled.
+func (c *DockerTLSConfig) IsEnabled() bool {
+	return c != nil && (c.Enabled == nil || *c.Enabled)
+}
+
+// NewDockerClient returns a client for the configured Docker endpoint. Without
+// an endpoint, DOCKER_HOST and the TLS certificates in DOCKER_CERT_PATH are
+// used like the Docker CLI does. Without a configured API version, the
+// version is negotiated with the daemon: the older of the daemon's version
+// and the latest version known to the beat is used.
+func NewDockerClient(cfg Config) (*docker.Client, error) {
+	endpoint, tlsConfig := dockerEndpoint(cfg, os.Getenv)
+
+	apiVersion := cfg.DockerAPIVersion
+	if apiVersion == "" {
+		version, err := negotiateDockerAPIVersion(endpoint, tlsConfig, cfg)
+		if err != nil {
+			logp.Warn("nvidiadocker: failed to negotiate the Docker API version with %s, using the daemon's version: %v", endpoint, err)
+		}
+		apiVersion = version
+	}
+	return newDockerClient(endpoint, tlsConfig, apiVersion, cfg)
+}
+
+// dockerEndpoint returns the Docker endpoint and its TLS configuration, from
+// the configuration or else from the environment of the Docker CLI.
+func dockerEndpoint(cfg Config, getenv func(string) string) (string, *DockerTLSConfig) {
+	endpoint := cfg.DockerEndpoint
+	if endpoint == "" {
+		endpoint = getenv("DOCKER_HOST")
+	}
+	if endpoint == "" {
+		endpoint = DefaultDockerEndpoint
+	}
+
+	if cfg.SSL != nil || !strings.HasPrefix(endpoint, "tcp://") {
+		return endpoint, cfg.SSL
+	}
+
+	// DOCKER_TLS_VERIFY enables TLS with the certificates in DOCKER_CERT_PATH,
+	// which default to ~/.docker. With only DOCKER_CERT_PATH, the client
+	// certificate is used without verifying the daemon.
+	tlsVerify := getenv("DOCKER_TLS_VERIFY") != ""
+	certPath := getenv("DOCKER_CERT_PATH")
+	if !tlsVerify && certPath == "" {
+		return endpoint, nil
+	}
+	if certPath == "" {
+		certPath = filepath.Join(getenv("HOME"), ".docker")
+	}
+
+	tlsConfig := &DockerTLSConfig{
+		CertificateAuthorities: []string{filepath.Join(certPath, "ca.pem")},
+		Certificate:            filepath.Join(certPath, "cert.pem"),
+		Key:                    filepath.Join(certPath, "key.pem"),
+	}
+	if !tlsVerify {
+		tlsConfig.CertificateAuthorities = nil
+		tlsConfig.VerificationMode = verificationModeNone
+	}
+	return endpoint, tlsConfig
+}
+
+// negotiateDockerAPIVersion returns the older of the daemon's API version and
+// dockerMaxAPIVersion. It gives up after the fetch timeout.
+func negotiateDockerAPIVersion(endpoint string, tlsConfig *DockerTLSConfig, cfg Config) (string, error) {
+	client, err := newDockerClient(endpoint, tlsConfig, "", cfg)
+	if err != nil {
+		return "", err
+	}
+	if timeout := cfg.fetchTimeout(); timeout > 0 {
+		client.SetTimeout(timeout)
+	}
+
+	env, err := client.Version()
+	if err != nil {
+		return "", err
+	}
+	serverVersion, err := docker.NewAPIVersion(env.Get("ApiVersion"))
+	if err != nil {
+		return "", err
+	}
+
+	maxVersion, _ := docker.NewAPIVersion(dockerMaxAPIVersion)
+	if serverVersion.LessThan(maxVersion) {
+		return serverVersion.String(), nil
+	}
+	return maxVersion.String(), nil
+}
+
+// newDockerClient returns a client of the endpoint using the API version, or
+// the daemon's version if it is empty, with the configured timeouts.
+func newDockerClient(endpoint string, tlsConfig *DockerTLSConfig, apiVersion string, cfg Config) (*docker.Client, error) {
+	var (
+		client *docker.Client
+		err    error
+	)
+	if tlsConfig.IsEnabled() {
+		client, err = newDockerTLSClient(endpoint, tlsConfig, apiVersion)
+	} else {
+		client, err = docker.NewVersionedClient(endpoint, apiVersion)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The version is either negotiated or configured, so the client doesn't
+	// need to check it before every first request.
+	client.SkipServerVersionCheck = true
+
+	if cfg.DockerConnectTimeout > 0 {
+		dialer := &net.Dialer{Timeout: cfg.DockerConnectTimeout, KeepAlive: 30 * time.Second}
+		client.Dialer = dialer
+		if transport, ok := client.HTTPClient.Transport.(*http.Transport); ok {
+			transport.Dial = dialer.Dial
+		}
+	}
+	// The timeout applies to the requests of the client, but not to the
+	// event stream, which dials the daemon itself.
+	if cfg.DockerTimeout > 0 {
+		client.SetTimeout(cfg.DockerTimeout)
+	}
+	return client, nil
+}
+
+// newDockerTLSClient returns a client of the endpoint with the certificate
+// authorities, certificate and key of the TLS configuration. Without
+// certificate authorities, the daemon's certificate is verified with the
+// certificate authorities of the host.
+func newDockerTLSClient(endpoint string, tlsConfig *DockerTLSConfig, apiVersion string) (*docker.Client, error) {
+	cas := append([]string{}, tlsConfig.CertificateAuthorities...)
+	if tlsConfig.CertificateAuthority != "" {
+		cas = append(cas, tlsConfig.CertificateAuthority)
+	}
+
+	var caPEMCerts []byte
+	for _, ca := range cas {
+		caPEMCert, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the certificate authority: %v", err)
+		}
+		caPEMCerts = append(append(caPEMCerts, caPEMCert...), '\n')
+	}
+
+	var certPEMBlock, keyPEMBlock []byte
+	if tlsConfig.Certificate != "" || tlsConfig.Key != "" {
+		var err error
+		if certPEMBlock, err = ioutil.ReadFile(tlsConfig.Certificate); err != nil {
+			return nil, fmt.Errorf("failed to read the certificate: %v", err)
+		}
+		if keyPEMBlock, err = ioutil.ReadFile(tlsConfig.Key); err != nil {
+			return nil, fmt.Errorf("failed to read the certificate key: %v", err)
+		}
+	}
+
+	client, err := docker.NewVersionedTLSClientFromBytes(endpoint, certPEMBlock, keyPEMBlock, caPEMCerts, apiVersion)
+	if err != nil {
+		return nil, err
+	}
+	// The client skips the verification without certificate authorities, the
+	// transport shares its TLS configuration.
+	client.TLSConfig.InsecureSkipVerify = tlsConfig.VerificationMode == verificationModeNone
+	return client, nil
+}
+
+// dockerClient adapts the Docker client, whose methods take the context of its
+// vendored golang.org/x/net/context, to the interfaces of this package.
+type dockerClient struct {
+	*docker.Client
+}
+
+func (c dockerClient) InspectContainerWithContext(id string, ctx context.Context) (*docker.Container, error) {
+	return c.Client.InspectContainerWithContext(id, ctx)
+}
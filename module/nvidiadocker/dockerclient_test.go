@@ -0,0 +1,129 @@
+package nvidiadocker
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	docker "github.com/fpgeek/go-dockerclient"
+)
+
+func TestDockerEndpoint(t *testing.T) {
+	tests := []struct {
+		cfg      Config
+		env      map[string]string
+		endpoint string
+		tls      *DockerTLSConfig
+	}{
+		{Config{}, nil, DefaultDockerEndpoint, nil},
+		{Config{DockerEndpoint: "unix:///run/docker.sock"}, map[string]string{"DOCKER_HOST": "tcp://gpu-1:2376"}, "unix:///run/docker.sock", nil},
+		{Config{}, map[string]string{"DOCKER_HOST": "tcp://gpu-1:2375"}, "tcp://gpu-1:2375", nil},
+		{
+			Config{},
+			map[string]string{"DOCKER_HOST": "tcp://gpu-1:2376", "DOCKER_TLS_VERIFY": "1", "DOCKER_CERT_PATH": "/certs"},
+			"tcp://gpu-1:2376",
+			&DockerTLSConfig{CertificateAuthorities: []string{"/certs/ca.pem"}, Certificate: "/certs/cert.pem", Key: "/certs/key.pem"},
+		},
+		{
+			Config{DockerEndpoint: "tcp://gpu-1:2376"},
+			map[string]string{"DOCKER_TLS_VERIFY": "1", "HOME": "/home/beat"},
+			"tcp://gpu-1:2376",
+			&DockerTLSConfig{CertificateAuthorities: []string{"/home/beat/.docker/ca.pem"}, Certificate: "/home/beat/.docker/cert.pem", Key: "/home/beat/.docker/key.pem"},
+		},
+		{
+			Config{DockerEndpoint: "tcp://gpu-1:2376"},
+			map[string]string{"DOCKER_CERT_PATH": "/certs"},
+			"tcp://gpu-1:2376",
+			&DockerTLSConfig{Certificate: "/certs/cert.pem", Key: "/certs/key.pem", VerificationMode: verificationModeNone},
+		},
+		// The configured TLS settings take precedence over the environment.
+		{
+			Config{DockerEndpoint: "tcp://gpu-1:2376", SSL: &DockerTLSConfig{CertificateAuthorities: []string{"/etc/ca.pem"}}},
+			map[string]string{"DOCKER_TLS_VERIFY": "1", "DOCKER_CERT_PATH": "/certs"},
+			"tcp://gpu-1:2376",
+			&DockerTLSConfig{CertificateAuthorities: []string{"/etc/ca.pem"}},
+		},
+	}
+
+	for _, test := range tests {
+		endpoint, tlsConfig := dockerEndpoint(test.cfg, func(key string) string {
+			return test.env[key]
+		})
+		if endpoint != test.endpoint {
+			t.Errorf("expected endpoint %s, got %s", test.endpoint, endpoint)
+		}
+		if !reflect.DeepEqual(tlsConfig, test.tls) {
+			t.Errorf("expected TLS config %+v, got %+v", test.tls, tlsConfig)
+		}
+	}
+}
+
+func TestNewDockerClientTLS(t *testing.T) {
+	var paths []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		switch r.URL.Path {
+		case "/version":
+			w.Write([]byte(`{"ApiVersion":"1.30","Version":"17.06.0-ce"}`))
+		case "/v1.30/containers/json":
+			w.Write([]byte(`[{"Id":"4e3bb646c7ff","Names":["/trainer"]}]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "dockertls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(ca, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.DockerEndpoint = "tcp://" + server.Listener.Addr().String()
+	// The certificate authority setting of the docker module is supported too.
+	cfg.SSL = &DockerTLSConfig{CertificateAuthority: ca}
+
+	client, err := NewDockerClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	containers, err := client.ListContainers(docker.ListContainersOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != 1 || containers[0].ID != "4e3bb646c7ff" {
+		t.Fatalf("unexpected containers %v", containers)
+	}
+	if !reflect.DeepEqual(paths, []string{"/version", "/v1.30/containers/json"}) {
+		t.Fatalf("expected the negotiated API version to be used, got %v", paths)
+	}
+
+	// The daemon's certificate isn't trusted by the host.
+	cfg.SSL = &DockerTLSConfig{}
+	cfg.DockerAPIVersion = "1.30"
+	client, err = NewDockerClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.ListContainers(docker.ListContainersOptions{}); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("expected a certificate error, got %v", err)
+	}
+
+	cfg.SSL = &DockerTLSConfig{CertificateAuthorities: []string{filepath.Join(dir, "missing.pem")}}
+	if _, err := NewDockerClient(cfg); err == nil {
+		t.Fatal("expected an error for a missing certificate authority")
+	}
+}
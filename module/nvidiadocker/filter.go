@@ -0,0 +1,144 @@
+package nvidiadocker
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ContainerFilter selects the containers to report by their name, image and
+// labels. A container is reported if it matches any of the include rules of
+// each kind that has rules and none of the exclude rules. All include labels
+// must be present, like the label filters of `docker ps`. A nil filter
+// matches all containers.
+type ContainerFilter struct {
+	includeNames  []*regexp.Regexp
+	excludeNames  []*regexp.Regexp
+	includeImages []string
+	excludeImages []string
+	includeLabels []labelRule
+	excludeLabels []labelRule
+}
+
+// labelRule matches a label with a key, and with a value if it has one.
+type labelRule struct {
+	key      string
+	value    string
+	hasValue bool
+}
+
+// NewContainerFilter returns the filter of the include and exclude rules of
+// the configuration. It returns nil without rules.
+func NewContainerFilter(cfg Config) (*ContainerFilter, error) {
+	var (
+		f   = &ContainerFilter{}
+		err error
+	)
+	if f.includeNames, err = compileNameRules("includenames", cfg.IncludeNames); err != nil {
+		return nil, err
+	}
+	if f.excludeNames, err = compileNameRules("excludenames", cfg.ExcludeNames); err != nil {
+		return nil, err
+	}
+	if f.includeLabels, err = parseLabelRules("includelabels", cfg.IncludeLabels); err != nil {
+		return nil, err
+	}
+	if f.excludeLabels, err = parseLabelRules("excludelabels", cfg.ExcludeLabels); err != nil {
+		return nil, err
+	}
+	f.includeImages = cfg.IncludeImages
+	f.excludeImages = cfg.ExcludeImages
+
+	if len(f.includeNames) == 0 && len(f.excludeNames) == 0 &&
+		len(f.includeImages) == 0 && len(f.excludeImages) == 0 &&
+		len(f.includeLabels) == 0 && len(f.excludeLabels) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+func compileNameRules(option string, rules []string) ([]*regexp.Regexp, error) {
+	regexps := make([]*regexp.Regexp, 0, len(rules))
+	for _, rule := range rules {
+		re, err := regexp.Compile(rule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s regexp '%s': %v", option, rule, err)
+		}
+		regexps = append(regexps, re)
+	}
+	return regexps, nil
+}
+
+// parseLabelRules parses label rules given as `key` or `key=value`.
+func parseLabelRules(option string, rules []string) ([]labelRule, error) {
+	labelRules := make([]labelRule, 0, len(rules))
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+		if parts[0] == "" {
+			return nil, fmt.Errorf("invalid %s rule '%s', must be 'key' or 'key=value'", option, rule)
+		}
+		labelRule := labelRule{key: parts[0]}
+		if len(parts) == 2 {
+			labelRule.value = parts[1]
+			labelRule.hasValue = true
+		}
+		labelRules = append(labelRules, labelRule)
+	}
+	return labelRules, nil
+}
+
+// Match returns true if a container with the given name, image and labels is
+// reported. The name is matched without the leading slash of Docker.
+func (f *ContainerFilter) Match(name string, image string, labels map[string]string) bool {
+	if f == nil {
+		return true
+	}
+	name = strings.TrimPrefix(name, "/")
+
+	if len(f.includeNames) > 0 && !matchName(f.includeNames, name) {
+		return false
+	}
+	if len(f.includeImages) > 0 && !matchImage(f.includeImages, image) {
+		return false
+	}
+	for _, rule := range f.includeLabels {
+		if !rule.match(labels) {
+			return false
+		}
+	}
+
+	if matchName(f.excludeNames, name) || matchImage(f.excludeImages, image) {
+		return false
+	}
+	for _, rule := range f.excludeLabels {
+		if rule.match(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r labelRule) match(labels map[string]string) bool {
+	value, found := labels[r.key]
+	return found && (!r.hasValue || value == r.value)
+}
+
+func matchName(regexps []*regexp.Regexp, name string) bool {
+	for _, re := range regexps {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchImage returns true if the image is one of the given images. An image
+// without a tag or digest matches all of its tags and digests.
+func matchImage(images []string, image string) bool {
+	for _, rule := range images {
+		if image == rule || strings.HasPrefix(image, rule+":") || strings.HasPrefix(image, rule+"@") {
+			return true
+		}
+	}
+	return false
+}
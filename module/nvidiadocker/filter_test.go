@@ -0,0 +1,62 @@
+package nvidiadocker
+
+import (
+	"testing"
+)
+
+func TestContainerFilter(t *testing.T) {
+	filter, err := NewContainerFilter(Config{
+		IncludeNames:  []string{"^train-", "^eval-"},
+		ExcludeNames:  []string{"-debug$"},
+		IncludeImages: []string{"nvidia/cuda", "tensorflow/tensorflow:1.2.1-gpu"},
+		IncludeLabels: []string{"team=ml", "gpu"},
+		ExcludeLabels: []string{"skip-monitoring"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	labels := map[string]string{"team": "ml", "gpu": ""}
+	tests := []struct {
+		name   string
+		image  string
+		labels map[string]string
+		match  bool
+	}{
+		{"/train-0", "nvidia/cuda:11.0", labels, true},
+		{"eval-0", "nvidia/cuda", labels, true},
+		{"eval-0", "tensorflow/tensorflow:1.2.1-gpu", labels, true},
+		{"eval-0", "tensorflow/tensorflow:latest", labels, false},
+		{"eval-0", "nvidia/cudagl:11.0", labels, false},
+		{"web", "nvidia/cuda:11.0", labels, false},
+		{"train-0-debug", "nvidia/cuda:11.0", labels, false},
+		{"train-0", "nvidia/cuda:11.0", map[string]string{"team": "ml"}, false},
+		{"train-0", "nvidia/cuda:11.0", map[string]string{"team": "web", "gpu": ""}, false},
+		{"train-0", "nvidia/cuda:11.0", map[string]string{"team": "ml", "gpu": "", "skip-monitoring": "true"}, false},
+	}
+	for _, test := range tests {
+		if match := filter.Match(test.name, test.image, test.labels); match != test.match {
+			t.Errorf("expected %s %s %v to match %v, got %v", test.name, test.image, test.labels, test.match, match)
+		}
+	}
+}
+
+func TestContainerFilterNil(t *testing.T) {
+	filter, err := NewContainerFilter(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter != nil {
+		t.Fatal("expected no filter without rules")
+	}
+	if !filter.Match("web", "nginx", nil) {
+		t.Fatal("expected a nil filter to match all containers")
+	}
+
+	if _, err := NewContainerFilter(Config{IncludeNames: []string{"("}}); err == nil {
+		t.Fatal("expected an error for an invalid regexp")
+	}
+	if _, err := NewContainerFilter(Config{ExcludeLabels: []string{"=value"}}); err == nil {
+		t.Fatal("expected an error for a label rule without key")
+	}
+}
@@ -0,0 +1,113 @@
+package nvidiadocker
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/metricbeat/mb"
+)
+
+const (
+	dockerPort    = "2375"
+	dockerTLSPort = "2376"
+	pluginPort    = "3476"
+)
+
+// IsLocalHost returns true for the configured hosts which name the host the
+// beat runs on.
+func IsLocalHost(host string) bool {
+	switch host {
+	case "", "localhost", "127.0.0.1", "::1":
+		return true
+	}
+	return false
+}
+
+// HostConfig returns the configuration of a metricset collecting from one of
+// the configured hosts. The local host is collected from as configured. A
+// remote host is collected from its Docker endpoint and the REST API of its
+// nvidia-docker-plugin: the host of `dockerendpoint` and `apiurl` is replaced
+// with the remote host, keeping their ports, or the default ports are used if
+// they aren't tcp or http URLs. The Docker API is only read from its default
+// port with ssl, as the unencrypted port has to be chosen explicitly with a
+// tcp `dockerendpoint`. The GPU status of a remote host is read from
+// nvidia-docker-plugin. The proc filesystem, kubelet checkpoint and kernel log
+// of the beat's host don't belong to a remote host, so they are not used.
+func HostConfig(cfg Config, host string) (Config, error) {
+	if IsLocalHost(host) {
+		return cfg, nil
+	}
+	if cfg.Runtime == criRuntimeName {
+		return cfg, fmt.Errorf("the '%s' runtime only supports the local host, not '%s'", criRuntimeName, host)
+	}
+
+	dockerEndpoint, err := replaceURLHost(cfg.DockerEndpoint, host, "", "tcp")
+	if err != nil {
+		return cfg, fmt.Errorf("invalid dockerendpoint '%s': %v", cfg.DockerEndpoint, err)
+	}
+	if dockerEndpoint == "" {
+		if !cfg.SSL.IsEnabled() {
+			return cfg, fmt.Errorf("remote host '%s' needs ssl or a tcp dockerendpoint like 'tcp://localhost:%s' to read the unencrypted Docker API", host, dockerPort)
+		}
+		dockerEndpoint = "tcp://" + net.JoinHostPort(host, dockerTLSPort)
+	}
+	apiURL, err := replaceURLHost(cfg.APIURL, host, "http://"+net.JoinHostPort(host, pluginPort), "http", "https")
+	if err != nil {
+		return cfg, fmt.Errorf("invalid apiurl '%s': %v", cfg.APIURL, err)
+	}
+
+	cfg.DockerEndpoint = dockerEndpoint
+	cfg.APIURL = apiURL
+	cfg.GPUBackend = pluginBackendName
+	cfg.ProcPath = ""
+	cfg.KubeletCheckpoint = ""
+	cfg.KmsgPath = ""
+	return cfg, nil
+}
+
+// replaceURLHost returns rawURL with its host replaced, or defaultURL if
+// rawURL is not a URL with one of the schemes, e.g. a unix socket.
+func replaceURLHost(rawURL string, host string, defaultURL string, schemes ...string) (string, error) {
+	if rawURL == "" {
+		return defaultURL, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	for _, scheme := range schemes {
+		if u.Scheme == scheme && u.Host != "" {
+			if port := u.Port(); port != "" {
+				u.Host = net.JoinHostPort(host, port)
+			} else {
+				u.Host = host
+			}
+			return u.String(), nil
+		}
+	}
+	return defaultURL, nil
+}
+
+// HostName returns the name events of a configured host are tagged with, the
+// hostname of the beat's host for the local host.
+func HostName(host string) string {
+	if IsLocalHost(host) {
+		if hostname, err := os.Hostname(); err == nil {
+			return hostname
+		}
+	}
+	return host
+}
+
+// TagHost tags the events with the host they were collected from, reported
+// in `nvidiadocker.host`.
+func TagHost(events []common.MapStr, hostName string) []common.MapStr {
+	for _, event := range events {
+		event[mb.ModuleData] = common.MapStr{"host": hostName}
+	}
+	return events
+}
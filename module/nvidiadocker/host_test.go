@@ -0,0 +1,64 @@
+package nvidiadocker
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/metricbeat/mb"
+)
+
+func TestHostConfig(t *testing.T) {
+	enabled := true
+	tests := []struct {
+		cfg            Config
+		dockerEndpoint string
+		apiURL         string
+	}{
+		{Config{DockerEndpoint: "tcp://localhost:2375", APIURL: "http://localhost:3476"}, "tcp://gpu-1:2375", "http://gpu-1:3476"},
+		{Config{DockerEndpoint: "tcp://localhost:12375", APIURL: "https://localhost:13476/v1.0"}, "tcp://gpu-1:12375", "https://gpu-1:13476/v1.0"},
+		{Config{SSL: &DockerTLSConfig{Enabled: &enabled}}, "tcp://gpu-1:2376", "http://gpu-1:3476"},
+		{Config{DockerEndpoint: DefaultDockerEndpoint, SSL: &DockerTLSConfig{Enabled: &enabled}}, "tcp://gpu-1:2376", "http://gpu-1:3476"},
+	}
+
+	for _, test := range tests {
+		test.cfg.ProcPath = "/proc"
+		test.cfg.KubeletCheckpoint = "/var/lib/kubelet/device-plugins/kubelet_internal_checkpoint"
+		cfg, err := HostConfig(test.cfg, "gpu-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.DockerEndpoint != test.dockerEndpoint || cfg.APIURL != test.apiURL {
+			t.Errorf("expected %s and %s, got %s and %s", test.dockerEndpoint, test.apiURL, cfg.DockerEndpoint, cfg.APIURL)
+		}
+		if cfg.GPUBackend != pluginBackendName || cfg.ProcPath != "" || cfg.KubeletCheckpoint != "" {
+			t.Errorf("expected only the plugin of the remote host to be used, got %+v", cfg)
+		}
+	}
+
+	local := Config{DockerEndpoint: DefaultDockerEndpoint, ProcPath: "/proc"}
+	if cfg, err := HostConfig(local, "localhost"); err != nil || !reflect.DeepEqual(cfg, local) {
+		t.Fatalf("expected the local host to be collected from as configured, got %+v, %v", cfg, err)
+	}
+	if _, err := HostConfig(Config{Runtime: criRuntimeName}, "gpu-1"); err == nil {
+		t.Fatal("expected an error for the cri runtime of a remote host")
+	}
+
+	// The unencrypted Docker API isn't used unless it is configured.
+	for _, cfg := range []Config{{}, {DockerEndpoint: DefaultDockerEndpoint}} {
+		if _, err := HostConfig(cfg, "gpu-1"); err == nil || !strings.Contains(err.Error(), "needs ssl") {
+			t.Fatalf("expected an error for the default Docker endpoint of a remote host without ssl, got %v", err)
+		}
+	}
+}
+
+func TestTagHost(t *testing.T) {
+	events := TagHost([]common.MapStr{{"gpu": common.MapStr{"index": 0}}}, "gpu-1")
+	if host, _ := events[0].GetValue(mb.ModuleData + ".host"); host != "gpu-1" {
+		t.Fatalf("expected the event to be tagged with gpu-1, got %v", events[0])
+	}
+	if HostName("gpu-1") != "gpu-1" {
+		t.Fatal("expected a remote host to be reported as configured")
+	}
+}
@@ -0,0 +1,135 @@
+package nvidiadocker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	// DefaultKubeletCheckpointPath is where the kubelet records the devices
+	// allocated by device plugins.
+	DefaultKubeletCheckpointPath = "/var/lib/kubelet/device-plugins/kubelet_internal_checkpoint"
+
+	nvidiaGPUResourceName = "nvidia.com/gpu"
+	// kubeletReplicaSeparator separates the GPU from the replica in the
+	// device IDs of a GPU shared by time-slicing or MPS.
+	kubeletReplicaSeparator = "::"
+)
+
+type kubeletCheckpoint struct {
+	Data struct {
+		PodDeviceEntries []kubeletPodDeviceEntry
+	}
+}
+
+type kubeletPodDeviceEntry struct {
+	PodUID        string
+	ContainerName string
+	ResourceName  string
+	// DeviceIDs is a list of device IDs up to Kubernetes 1.19 and a map of
+	// NUMA node to device IDs since.
+	DeviceIDs json.RawMessage
+}
+
+type kubeletContainerKey struct {
+	podUID        string
+	containerName string
+}
+
+// KubeletAllocations are the nvidia.com/gpu device IDs, i.e. GPU UUIDs, the
+// kubelet allocated to the containers of its pods.
+type KubeletAllocations map[kubeletContainerKey][]string
+
+// ReadKubeletCheckpoint reads the GPU allocations from the kubelet device
+// plugin checkpoint. A missing checkpoint, e.g. on a host without kubelet, or
+// no path, e.g. for a remote host, results in no allocations.
+func ReadKubeletCheckpoint(path string) (KubeletAllocations, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return parseKubeletCheckpoint(data)
+}
+
+func parseKubeletCheckpoint(data []byte) (KubeletAllocations, error) {
+	var checkpoint kubeletCheckpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, err
+	}
+
+	allocations := KubeletAllocations{}
+	for _, entry := range checkpoint.Data.PodDeviceEntries {
+		if entry.ResourceName != nvidiaGPUResourceName {
+			continue
+		}
+
+		deviceIDs, err := parseKubeletDeviceIDs(entry.DeviceIDs)
+		if err != nil {
+			return nil, err
+		}
+
+		key := kubeletContainerKey{podUID: entry.PodUID, containerName: entry.ContainerName}
+		allocations[key] = append(allocations[key], deviceIDs...)
+	}
+	return allocations, nil
+}
+
+func parseKubeletDeviceIDs(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+
+	var deviceIDs []string
+	if err := json.Unmarshal(raw, &deviceIDs); err == nil {
+		return deviceIDs, nil
+	}
+
+	var numaDeviceIDs map[string][]string
+	if err := json.Unmarshal(raw, &numaDeviceIDs); err != nil {
+		return nil, err
+	}
+	numaNodes := make([]string, 0, len(numaDeviceIDs))
+	for numaNode := range numaDeviceIDs {
+		numaNodes = append(numaNodes, numaNode)
+	}
+	sort.Strings(numaNodes)
+	for _, numaNode := range numaNodes {
+		deviceIDs = append(deviceIDs, numaDeviceIDs[numaNode]...)
+	}
+	return deviceIDs, nil
+}
+
+// DeviceIDs returns the GPU device IDs the kubelet allocated to the container
+// with the given labels and whether the kubelet allocated GPUs to it at all.
+// The replicas of a shared GPU, `<uuid>::<n>` with time-slicing or MPS, are
+// returned as the ID of the GPU.
+func (a KubeletAllocations) DeviceIDs(labels map[string]string) ([]string, bool) {
+	pod := GetKubernetesMetadata(labels)
+	if pod == nil {
+		return nil, false
+	}
+	allocated, found := a[kubeletContainerKey{podUID: pod.PodUID, containerName: pod.ContainerName}]
+	if !found {
+		return nil, false
+	}
+
+	deviceIDs := make([]string, 0, len(allocated))
+	for _, deviceID := range allocated {
+		if sep := strings.Index(deviceID, kubeletReplicaSeparator); sep >= 0 {
+			deviceID = deviceID[:sep]
+		}
+		if !containsString(deviceIDs, deviceID) {
+			deviceIDs = append(deviceIDs, deviceID)
+		}
+	}
+	return deviceIDs, true
+}
@@ -0,0 +1,58 @@
+package nvidiadocker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseKubeletCheckpoint(t *testing.T) {
+	tests := []struct {
+		Checkpoint  string
+		Allocations KubeletAllocations
+	}{
+		{
+			Checkpoint: `{"Data":{"PodDeviceEntries":[` +
+				`{"PodUID":"pod-1","ContainerName":"trainer","ResourceName":"nvidia.com/gpu","DeviceIDs":["GPU-66a2874a-837d-cd53-ab26-0d2d842d9822","GPU-535c289c-6dd8-e308-b4ca-524b0fc07fa6"],"AllocResp":"CiIKFk5WSURJQV9WSVNJQkxFX0RFVklDRVM="},` +
+				`{"PodUID":"pod-1","ContainerName":"trainer","ResourceName":"example.com/fpga","DeviceIDs":["fpga-0"],"AllocResp":""}],` +
+				`"RegisteredDevices":{"nvidia.com/gpu":["GPU-66a2874a-837d-cd53-ab26-0d2d842d9822","GPU-535c289c-6dd8-e308-b4ca-524b0fc07fa6"]}},"Checksum":1921542296}`,
+			Allocations: KubeletAllocations{
+				{podUID: "pod-1", containerName: "trainer"}: {
+					"GPU-66a2874a-837d-cd53-ab26-0d2d842d9822",
+					"GPU-535c289c-6dd8-e308-b4ca-524b0fc07fa6",
+				},
+			},
+		},
+		{
+			// Kubernetes 1.20 and later group the device IDs by NUMA node.
+			Checkpoint: `{"Data":{"PodDeviceEntries":[` +
+				`{"PodUID":"pod-2","ContainerName":"cuda","ResourceName":"nvidia.com/gpu","DeviceIDs":{"1":["GPU-149648d8-7e32-715a-b5c3-fe6df5976c7e"],"0":["GPU-66a2874a-837d-cd53-ab26-0d2d842d9822"]},"AllocResp":""}],` +
+				`"RegisteredDevices":{}},"Checksum":2015387392}`,
+			Allocations: KubeletAllocations{
+				{podUID: "pod-2", containerName: "cuda"}: {
+					"GPU-66a2874a-837d-cd53-ab26-0d2d842d9822",
+					"GPU-149648d8-7e32-715a-b5c3-fe6df5976c7e",
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		allocations, err := parseKubeletCheckpoint([]byte(test.Checkpoint))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(allocations, test.Allocations) {
+			t.Fatalf("expected %v, got %v", test.Allocations, allocations)
+		}
+	}
+}
+
+func TestReadKubeletCheckpointMissing(t *testing.T) {
+	allocations, err := ReadKubeletCheckpoint("/nonexistent/kubelet_internal_checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocations) != 0 {
+		t.Fatalf("expected no allocations, got %v", allocations)
+	}
+}
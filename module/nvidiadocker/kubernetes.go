@@ -0,0 +1,46 @@
+package nvidiadocker
+
+const (
+	kubernetesPodNameLabel       = "io.kubernetes.pod.name"
+	kubernetesPodNamespaceLabel  = "io.kubernetes.pod.namespace"
+	kubernetesPodUIDLabel        = "io.kubernetes.pod.uid"
+	kubernetesContainerNameLabel = "io.kubernetes.container.name"
+	kubernetesDockerTypeLabel    = "io.kubernetes.docker.type"
+
+	kubernetesPodSandboxDockerType = "podsandbox"
+	kubernetesPodSandboxName       = "POD"
+)
+
+// KubernetesMetadata identifies the pod and container of a container started
+// by the kubelet.
+type KubernetesMetadata struct {
+	PodName       string
+	Namespace     string
+	PodUID        string
+	ContainerName string
+}
+
+// GetKubernetesMetadata returns the Kubernetes metadata from the io.kubernetes.*
+// labels of a container, or nil if the container was not started by the kubelet.
+func GetKubernetesMetadata(labels map[string]string) *KubernetesMetadata {
+	podUID := labels[kubernetesPodUIDLabel]
+	if podUID == "" {
+		return nil
+	}
+
+	return &KubernetesMetadata{
+		PodName:       labels[kubernetesPodNameLabel],
+		Namespace:     labels[kubernetesPodNamespaceLabel],
+		PodUID:        podUID,
+		ContainerName: labels[kubernetesContainerNameLabel],
+	}
+}
+
+// IsPodSandbox returns true if the labels belong to the pause container holding
+// the namespaces of a pod.
+func IsPodSandbox(labels map[string]string) bool {
+	if labels[kubernetesDockerTypeLabel] == kubernetesPodSandboxDockerType {
+		return true
+	}
+	return labels[kubernetesPodUIDLabel] != "" && labels[kubernetesContainerNameLabel] == kubernetesPodSandboxName
+}
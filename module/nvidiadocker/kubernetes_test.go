@@ -0,0 +1,71 @@
+package nvidiadocker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetKubernetesMetadata(t *testing.T) {
+	tests := []struct {
+		Labels   map[string]string
+		Metadata *KubernetesMetadata
+		Sandbox  bool
+	}{
+		{
+			Labels: map[string]string{
+				"io.kubernetes.container.name": "trainer",
+				"io.kubernetes.docker.type":    "container",
+				"io.kubernetes.pod.name":       "train-0",
+				"io.kubernetes.pod.namespace":  "ml",
+				"io.kubernetes.pod.uid":        "535c289c-6dd8-e308-b4ca-524b0fc07fa6",
+			},
+			Metadata: &KubernetesMetadata{
+				PodName:       "train-0",
+				Namespace:     "ml",
+				PodUID:        "535c289c-6dd8-e308-b4ca-524b0fc07fa6",
+				ContainerName: "trainer",
+			},
+		},
+		{
+			Labels: map[string]string{
+				"io.kubernetes.container.name": "POD",
+				"io.kubernetes.docker.type":    "podsandbox",
+				"io.kubernetes.pod.name":       "train-0",
+				"io.kubernetes.pod.namespace":  "ml",
+				"io.kubernetes.pod.uid":        "535c289c-6dd8-e308-b4ca-524b0fc07fa6",
+			},
+			Metadata: &KubernetesMetadata{
+				PodName:       "train-0",
+				Namespace:     "ml",
+				PodUID:        "535c289c-6dd8-e308-b4ca-524b0fc07fa6",
+				ContainerName: "POD",
+			},
+			Sandbox: true,
+		},
+		{
+			Labels: map[string]string{
+				"io.kubernetes.container.name": "POD",
+				"io.kubernetes.pod.uid":        "535c289c-6dd8-e308-b4ca-524b0fc07fa6",
+			},
+			Metadata: &KubernetesMetadata{
+				PodUID:        "535c289c-6dd8-e308-b4ca-524b0fc07fa6",
+				ContainerName: "POD",
+			},
+			Sandbox: true,
+		},
+		{
+			Labels: map[string]string{
+				"maintainer": "NVIDIA CORPORATION <cudatools@nvidia.com>",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		if metadata := GetKubernetesMetadata(test.Labels); !reflect.DeepEqual(metadata, test.Metadata) {
+			t.Fatalf("expected %+v, got %+v", test.Metadata, metadata)
+		}
+		if sandbox := IsPodSandbox(test.Labels); sandbox != test.Sandbox {
+			t.Fatalf("expected sandbox %v for %v", test.Sandbox, test.Labels)
+		}
+	}
+}
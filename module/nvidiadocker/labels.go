@@ -0,0 +1,112 @@
+package nvidiadocker
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/elastic/beats/libbeat/common"
+)
+
+// LabelFieldNames are the fixed top-level fields labels can be promoted to
+// with labelfields.
+var LabelFieldNames = []string{"team", "project", "jobid"}
+
+// LabelProcessor processes the container labels before they are reported.
+// Labels are selected by the allow and deny lists of label keys, where a key
+// ending in `*` matches all keys with its prefix, and the dots of their keys
+// are replaced with `_` if dedotting is enabled. Chosen labels are promoted to
+// fixed top-level fields, whether or not they are reported in the labels.
+// A nil processor reports the labels as they are.
+type LabelProcessor struct {
+	dedot bool
+	allow []string
+	deny  []string
+	// fields maps the top-level fields to the keys of the labels promoted to
+	// them.
+	fields map[string]string
+}
+
+// NewLabelProcessor returns the label processor of the configuration. It
+// returns nil without label options.
+func NewLabelProcessor(cfg Config) (*LabelProcessor, error) {
+	for field := range cfg.LabelFields {
+		if !isLabelFieldName(field) {
+			return nil, fmt.Errorf("unknown labelfields field '%s', must be one of %s", field, strings.Join(LabelFieldNames, ", "))
+		}
+	}
+
+	if !cfg.LabelDedot && len(cfg.LabelAllow) == 0 && len(cfg.LabelDeny) == 0 && len(cfg.LabelFields) == 0 {
+		return nil, nil
+	}
+	return &LabelProcessor{
+		dedot:  cfg.LabelDedot,
+		allow:  cfg.LabelAllow,
+		deny:   cfg.LabelDeny,
+		fields: cfg.LabelFields,
+	}, nil
+}
+
+func isLabelFieldName(field string) bool {
+	for _, name := range LabelFieldNames {
+		if field == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Labels returns the labels to report.
+func (p *LabelProcessor) Labels(labels map[string]string) map[string]string {
+	if p == nil || labels == nil {
+		return labels
+	}
+
+	processed := make(map[string]string, len(labels))
+	for key, value := range labels {
+		if len(p.allow) > 0 && !matchLabelKey(p.allow, key) {
+			continue
+		}
+		if matchLabelKey(p.deny, key) {
+			continue
+		}
+		if p.dedot {
+			key = dedotLabelKey(key)
+		}
+		processed[key] = value
+	}
+	return processed
+}
+
+// Fields returns the top-level fields of the promoted labels which are set.
+func (p *LabelProcessor) Fields(labels map[string]string) common.MapStr {
+	fields := common.MapStr{}
+	if p == nil {
+		return fields
+	}
+
+	for field, key := range p.fields {
+		if value, found := labels[key]; found {
+			fields[field] = value
+		}
+	}
+	return fields
+}
+
+// dedotLabelKey replaces the dots of a label key with `_`, so keys like
+// `com.nvidia.cuda.version` don't turn into object paths in Elasticsearch.
+func dedotLabelKey(key string) string {
+	return strings.Replace(key, ".", "_", -1)
+}
+
+func matchLabelKey(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(key, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		} else if key == pattern {
+			return true
+		}
+	}
+	return false
+}
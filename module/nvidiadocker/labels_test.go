@@ -0,0 +1,70 @@
+package nvidiadocker
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/elastic/beats/libbeat/common"
+)
+
+func TestLabelProcessor(t *testing.T) {
+	labels := map[string]string{
+		"com.nvidia.cuda.version":             "8.0.61",
+		"com.nvidia.volumes.needed":           "nvidia_driver",
+		"com.kakaobrain.cloud.framework.name": "tensorflow",
+		"com.kakaobrain.cloud.team":           "vision",
+		"maintainer":                          "ml-infra",
+		"job-id":                              "1234",
+	}
+
+	processor, err := NewLabelProcessor(Config{
+		LabelDedot: true,
+		LabelAllow: []string{"com.nvidia.*", "com.kakaobrain.cloud.*", "maintainer"},
+		LabelDeny:  []string{"com.nvidia.volumes.needed", "com.kakaobrain.cloud.team"},
+		LabelFields: map[string]string{
+			"team":  "com.kakaobrain.cloud.team",
+			"jobid": "job-id",
+			// Unset labels are not promoted.
+			"project": "com.kakaobrain.cloud.project",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"com_nvidia_cuda_version":             "8.0.61",
+		"com_kakaobrain_cloud_framework_name": "tensorflow",
+		"maintainer":                          "ml-infra",
+	}
+	if processed := processor.Labels(labels); !reflect.DeepEqual(processed, expected) {
+		t.Fatalf("expected %v, got %v", expected, processed)
+	}
+
+	expectedFields := common.MapStr{"team": "vision", "jobid": "1234"}
+	if fields := processor.Fields(labels); !reflect.DeepEqual(fields, expectedFields) {
+		t.Fatalf("expected %v, got %v", expectedFields, fields)
+	}
+}
+
+func TestLabelProcessorNil(t *testing.T) {
+	processor, err := NewLabelProcessor(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if processor != nil {
+		t.Fatal("expected no processor without label options")
+	}
+
+	labels := map[string]string{"com.nvidia.cuda.version": "8.0.61"}
+	if processed := processor.Labels(labels); !reflect.DeepEqual(processed, labels) {
+		t.Fatalf("expected the labels as they are, got %v", processed)
+	}
+	if fields := processor.Fields(labels); len(fields) != 0 {
+		t.Fatalf("expected no fields, got %v", fields)
+	}
+
+	if _, err := NewLabelProcessor(Config{LabelFields: map[string]string{"owner": "maintainer"}}); err == nil {
+		t.Fatal("expected an error for an unknown field")
+	}
+}
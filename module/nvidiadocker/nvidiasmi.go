@@ -0,0 +1,377 @@
+package nvidiadocker
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+const (
+	// DefaultNvidiaSMIPath is the nvidia-smi run by the nvidia-smi backend.
+	DefaultNvidiaSMIPath = "/usr/bin/nvidia-smi"
+
+	nvidiaSMIQueryComputeApps = "--query-compute-apps=pid,gpu_uuid,used_memory"
+	nvidiaSMIFormatNoUnits    = "--format=csv,noheader,nounits"
+	nvidiaSMIFormatHeader     = "--format=csv,nounits"
+)
+
+var (
+	// DefaultQueryGPUFields are the --query-gpu fields queried unless the
+	// querygpu setting is given.
+	DefaultQueryGPUFields = []string{
+		"index",
+		"uuid",
+		"name",
+		"pci.bus_id",
+		"temperature.gpu",
+		"fan.speed",
+		"pstate",
+		"utilization.gpu",
+		"utilization.memory",
+		"memory.total",
+		"memory.used",
+		"memory.free",
+		"power.draw",
+		"power.limit",
+		"clocks.sm",
+		"clocks.mem",
+		"pcie.link.gen.current",
+		"pcie.link.width.current",
+		"ecc.errors.corrected.volatile.total",
+		"ecc.errors.uncorrected.volatile.total",
+	}
+
+	// requiredQueryGPUFields identify a device and are always queried. The
+	// PCI bus ID maps the Xid errors of the kernel log to a device, and the
+	// minor number maps the /dev/nvidiaN device nodes. index must be first,
+	// as it marks the header of the loop mode output.
+	requiredQueryGPUFields = []string{"index", "uuid", "pci.bus_id", "minor_number"}
+)
+
+// nvidiaSMIColumn is a column of the CSV header, e.g. "memory.used [MiB]".
+type nvidiaSMIColumn struct {
+	Name string
+	Unit string
+}
+
+func nvidiaSMIQueryGPU(fields []string) string {
+	queryFields := make([]string, 0, len(requiredQueryGPUFields)+len(fields))
+	for _, field := range append(append([]string{}, requiredQueryGPUFields...), fields...) {
+		field = strings.TrimSpace(field)
+		if field != "" && !containsString(queryFields, field) {
+			queryFields = append(queryFields, field)
+		}
+	}
+	return "--query-gpu=" + strings.Join(queryFields, ",")
+}
+
+// getGPUDeviceStatus parses the CSV output of a --query-gpu run. The columns
+// are mapped by the field names of the header line. Lines which don't match
+// the header are skipped.
+func getGPUDeviceStatus(nvidiaSmiRunOutput string) ([]DeviceStatus, error) {
+	reader := csv.NewReader(strings.NewReader(strings.TrimSpace(nvidiaSmiRunOutput)))
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return []DeviceStatus{}, nil
+	}
+
+	columns := parseNvidiaSMIHeader(records[0])
+	deviceStatuses := make([]DeviceStatus, 0, len(records)-1)
+	for _, record := range records[1:] {
+		if len(record) != len(columns) {
+			logp.Debug("nvidiadocker", "skipping nvidia-smi output %v with %d instead of %d columns", record, len(record), len(columns))
+			continue
+		}
+		if deviceStatus, ok := parseNvidiaSMIRecord(columns, record); ok {
+			deviceStatuses = append(deviceStatuses, deviceStatus)
+		}
+	}
+	return deviceStatuses, nil
+}
+
+// parseNvidiaSMIRecord parses the status of a GPU from a --query-gpu output
+// line with the columns of the header. Fields whose values can't be parsed,
+// e.g. because a driver prints them differently, are left unset and listed
+// in InvalidFields, so the rest of the GPU's status is still reported. A line
+// whose index or UUID isn't valid could pose as another GPU, so it isn't
+// reported.
+func parseNvidiaSMIRecord(columns []nvidiaSMIColumn, record []string) (DeviceStatus, bool) {
+	deviceStatus := DeviceStatus{}
+	for i, column := range columns {
+		if err := setDeviceStatusField(&deviceStatus, column, strings.TrimSpace(record[i])); err != nil {
+			logp.Debug("nvidiadocker", "invalid value '%s' of %s: %v", record[i], column.Name, err)
+			deviceStatus.InvalidFields = append(deviceStatus.InvalidFields, column.Name)
+		}
+	}
+
+	for _, column := range columns {
+		if (column.Name == "index" && deviceStatus.Index == nil) || (column.Name == "uuid" && deviceStatus.UUID == "") {
+			logp.Debug("nvidiadocker", "skipping nvidia-smi output %v without a valid %s", record, column.Name)
+			return DeviceStatus{}, false
+		}
+	}
+
+	setMemoryUsage(&deviceStatus)
+	return deviceStatus, true
+}
+
+func parseNvidiaSMIHeader(header []string) []nvidiaSMIColumn {
+	columns := make([]nvidiaSMIColumn, 0, len(header))
+	for _, name := range header {
+		column := nvidiaSMIColumn{Name: strings.TrimSpace(name)}
+		if i := strings.Index(column.Name, " ["); i >= 0 && strings.HasSuffix(column.Name, "]") {
+			column.Unit = column.Name[i+2 : len(column.Name)-1]
+			column.Name = column.Name[:i]
+		}
+		columns = append(columns, column)
+	}
+	return columns
+}
+
+// setDeviceStatusField sets the DeviceStatus field of a known query field, and
+// passes unknown fields through in DeviceStatus.Fields.
+func setDeviceStatusField(deviceStatus *DeviceStatus, column nvidiaSMIColumn, value string) error {
+	if isNotAvailable(value) {
+		return nil
+	}
+
+	var err error
+	switch column.Name {
+	case "index":
+		var index uint
+		if index, err = parseUint(value); err == nil {
+			deviceStatus.Index = toUintP(index)
+		}
+	case "uuid":
+		deviceStatus.UUID = value
+	case "minor_number":
+		var minorNumber uint
+		if minorNumber, err = parseUint(value); err == nil {
+			deviceStatus.MinorNumber = toUintP(minorNumber)
+		}
+	case "name":
+		deviceStatus.Name = value
+	case "pci.bus_id":
+		deviceStatus.PCI.BusID = value
+	case "temperature.gpu":
+		deviceStatus.Temperature, err = parseUint(value)
+	case "fan.speed":
+		deviceStatus.FanSpeed, err = parseUint(value)
+	case "pstate":
+		deviceStatus.PState = value
+	case "utilization.gpu":
+		deviceStatus.Utilization.GPU, err = parseUint(value)
+	case "utilization.memory":
+		deviceStatus.Utilization.MemoryController, err = parseUint(value)
+	case "utilization.encoder":
+		deviceStatus.Utilization.Encoder, err = parseUint(value)
+	case "utilization.decoder":
+		deviceStatus.Utilization.Decoder, err = parseUint(value)
+	case "memory.total":
+		deviceStatus.Memory.Total, err = parseMiBytes(value)
+	case "memory.used":
+		deviceStatus.Memory.Used, err = parseMiBytes(value)
+	case "memory.free":
+		deviceStatus.Memory.Free, err = parseMiBytes(value)
+	case "power.draw":
+		deviceStatus.Power.Draw, err = strconv.ParseFloat(value, 64)
+	case "power.limit":
+		deviceStatus.Power.Limit, err = strconv.ParseFloat(value, 64)
+	case "clocks.sm":
+		deviceStatus.Clocks.Cores, err = parseUint(value)
+	case "clocks.mem":
+		deviceStatus.Clocks.Memory, err = parseUint(value)
+	case "pcie.link.gen.current":
+		deviceStatus.PCI.LinkGen, err = parseUint(value)
+	case "pcie.link.width.current":
+		deviceStatus.PCI.LinkWidth, err = parseUint(value)
+	case "ecc.errors.corrected.volatile.total":
+		deviceStatus.ECCErrors.Corrected, err = strconv.ParseUint(value, 10, 64)
+	case "ecc.errors.uncorrected.volatile.total":
+		deviceStatus.ECCErrors.Uncorrected, err = strconv.ParseUint(value, 10, 64)
+	default:
+		var fieldValue interface{}
+		if fieldValue, err = parseQueryValue(column, value); err != nil {
+			break
+		}
+		if deviceStatus.Fields == nil {
+			deviceStatus.Fields = map[string]QueryField{}
+		}
+		deviceStatus.Fields[column.Name] = QueryField{
+			Value: fieldValue,
+			Unit:  column.Unit,
+		}
+	}
+	return err
+}
+
+// isNotAvailable reports values like "[Not Supported]" or "N/A" which
+// nvidia-smi prints for fields a device doesn't provide.
+func isNotAvailable(value string) bool {
+	return value == "" || value == "N/A" || value == "[N/A]" || strings.HasPrefix(value, "[Not ")
+}
+
+func parseUint(value string) (uint, error) {
+	val, err := strconv.ParseUint(value, 10, 64)
+	return uint(val), err
+}
+
+// parseMiBytes parses a memory size in MiB, which nvidia-smi may print with
+// decimals, to bytes.
+func parseMiBytes(value string) (uint64, error) {
+	val, err := strconv.ParseFloat(value, 64)
+	return uint64(val * mebibyte), err
+}
+
+// parseQueryValue parses a passed through value by the unit of its column, so
+// a field always has the same type: values with a unit, like clocks.max.sm
+// [MHz], are numbers, and values without, like driver_version, are strings.
+func parseQueryValue(column nvidiaSMIColumn, value string) (interface{}, error) {
+	if column.Unit == "" {
+		return value, nil
+	}
+	return strconv.ParseFloat(value, 64)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// getComputeProcesses parses the output of the compute apps query into
+// processes keyed by the UUID of the GPU they run on. Lines which can't be
+// parsed are skipped.
+func getComputeProcesses(nvidiaSmiRunOutput string) (map[string][]ProcessInfo, error) {
+	processes := make(map[string][]ProcessInfo)
+	for _, line := range strings.Split(strings.TrimSpace(nvidiaSmiRunOutput), "\n") {
+		if uuid, process, ok := parseComputeProcess(line); ok {
+			processes[uuid] = append(processes[uuid], process)
+		}
+	}
+	return processes, nil
+}
+
+// parseComputeProcess parses a line of the compute apps query into the UUID
+// of the GPU and the process running on it.
+func parseComputeProcess(line string) (string, ProcessInfo, bool) {
+	contents := strings.Split(line, ",")
+	if len(contents) != 3 {
+		return "", ProcessInfo{}, false
+	}
+
+	pid, err := strconv.ParseUint(strings.TrimSpace(contents[0]), 10, 64)
+	if err != nil {
+		logp.Debug("nvidiadocker", "skipping compute process '%s': invalid pid: %v", line, err)
+		return "", ProcessInfo{}, false
+	}
+
+	usedMemory, err := strconv.ParseUint(strings.TrimSpace(contents[2]), 10, 64)
+	if err != nil {
+		logp.Debug("nvidiadocker", "skipping compute process '%s': invalid used memory: %v", line, err)
+		return "", ProcessInfo{}, false
+	}
+
+	return strings.TrimSpace(contents[1]), ProcessInfo{
+		PID:        uint(pid),
+		MemoryUsed: usedMemory,
+	}, true
+}
+
+// nvidiaSMICommand runs nvidia-smi as configured, optionally through a
+// wrapper like `chroot /host`.
+type nvidiaSMICommand struct {
+	path    string
+	wrapper []string
+	args    []string
+	env     []string
+	timeout time.Duration
+}
+
+func newNvidiaSMICommand(cfg Config) *nvidiaSMICommand {
+	path := cfg.NvidiaSMIPath
+	if path == "" {
+		path = DefaultNvidiaSMIPath
+	}
+	timeout := cfg.NvidiaSMITimeout
+	if timeout <= 0 {
+		timeout = cfg.Period
+	}
+
+	return &nvidiaSMICommand{
+		path:    path,
+		wrapper: cfg.NvidiaSMIWrapper,
+		args:    cfg.NvidiaSMIArgs,
+		env:     cfg.NvidiaSMIEnv,
+		timeout: timeout,
+	}
+}
+
+// command returns the command line running nvidia-smi with the given
+// arguments after the configured ones.
+func (c *nvidiaSMICommand) command(ctx context.Context, args ...string) *exec.Cmd {
+	commandLine := make([]string, 0, len(c.wrapper)+1+len(c.args)+len(args))
+	commandLine = append(commandLine, c.wrapper...)
+	commandLine = append(commandLine, c.path)
+	commandLine = append(commandLine, c.args...)
+	commandLine = append(commandLine, args...)
+
+	cmd := exec.CommandContext(ctx, commandLine[0], commandLine[1:]...)
+	if len(c.env) > 0 {
+		cmd.Env = append(os.Environ(), c.env...)
+	}
+	return cmd
+}
+
+// run runs nvidia-smi and returns its output. The error of a failed run
+// includes what nvidia-smi reported, which it writes to stdout for some
+// errors.
+func (c *nvidiaSMICommand) run(args ...string) (string, error) {
+	ctx := context.Background()
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := c.command(ctx, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("%s timed out after %v", c.path, c.timeout)
+		}
+		message := strings.TrimSpace(stderr.String())
+		if message == "" {
+			message = strings.TrimSpace(stdout.String())
+		}
+		if message != "" {
+			return "", fmt.Errorf("%s failed: %v: %s", c.path, err, message)
+		}
+		return "", fmt.Errorf("%s failed: %v", c.path, err)
+	}
+	return stdout.String(), nil
+}
+
+func toUintP(val uint) *uint {
+	return &val
+}
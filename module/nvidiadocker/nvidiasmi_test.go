@@ -0,0 +1,300 @@
+package nvidiadocker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetGPUDeviceStatus(t *testing.T) {
+	output := `index, utilization.gpu [%], memory.total [MiB], memory.used [MiB], temperature.gpu
+	0, 45, 22919, 21227, 48
+	1, 100, 22919, 15945, 51
+	2, 98, 22919, 16457, 69
+	3, 100, 22919, 21211, 76
+	4, 100, 22919, 21649, 52
+	5, 100, 22919, 21639, 52
+	6, 100, 22919, 21269, 71
+	7, 100, 22919, 16231, 79
+`
+	predictDevicesStatus := []DeviceStatus{
+		{
+			Index: toUintP(0),
+			Utilization: UtilizationInfo{
+				GPU:    45,
+				Memory: 92,
+			},
+			Memory: MemoryInfo{
+				Used:    21227 * mebibyte,
+				Total:   22919 * mebibyte,
+				UsedPct: 21227.0 / 22919.0,
+			},
+			Temperature: 48,
+		},
+		{
+			Index: toUintP(1),
+			Utilization: UtilizationInfo{
+				GPU:    100,
+				Memory: 69,
+			},
+			Memory: MemoryInfo{
+				Used:    15945 * mebibyte,
+				Total:   22919 * mebibyte,
+				UsedPct: 15945.0 / 22919.0,
+			},
+			Temperature: 51,
+		},
+		{
+			Index: toUintP(2),
+			Utilization: UtilizationInfo{
+				GPU:    98,
+				Memory: 71,
+			},
+			Memory: MemoryInfo{
+				Used:    16457 * mebibyte,
+				Total:   22919 * mebibyte,
+				UsedPct: 16457.0 / 22919.0,
+			},
+			Temperature: 69,
+		},
+		{
+			Index: toUintP(3),
+			Utilization: UtilizationInfo{
+				GPU:    100,
+				Memory: 92,
+			},
+			Memory: MemoryInfo{
+				Used:    21211 * mebibyte,
+				Total:   22919 * mebibyte,
+				UsedPct: 21211.0 / 22919.0,
+			},
+			Temperature: 76,
+		},
+		{
+			Index: toUintP(4),
+			Utilization: UtilizationInfo{
+				GPU:    100,
+				Memory: 94,
+			},
+			Memory: MemoryInfo{
+				Used:    21649 * mebibyte,
+				Total:   22919 * mebibyte,
+				UsedPct: 21649.0 / 22919.0,
+			},
+			Temperature: 52,
+		},
+		{
+			Index: toUintP(5),
+			Utilization: UtilizationInfo{
+				GPU:    100,
+				Memory: 94,
+			},
+			Memory: MemoryInfo{
+				Used:    21639 * mebibyte,
+				Total:   22919 * mebibyte,
+				UsedPct: 21639.0 / 22919.0,
+			},
+			Temperature: 52,
+		},
+		{
+			Index: toUintP(6),
+			Utilization: UtilizationInfo{
+				GPU:    100,
+				Memory: 92,
+			},
+			Memory: MemoryInfo{
+				Used:    21269 * mebibyte,
+				Total:   22919 * mebibyte,
+				UsedPct: 21269.0 / 22919.0,
+			},
+			Temperature: 71,
+		},
+		{
+			Index: toUintP(7),
+			Utilization: UtilizationInfo{
+				GPU:    100,
+				Memory: 70,
+			},
+			Memory: MemoryInfo{
+				Used:    16231 * mebibyte,
+				Total:   22919 * mebibyte,
+				UsedPct: 16231.0 / 22919.0,
+			},
+			Temperature: 79,
+		},
+	}
+	devicesStatus, err := getGPUDeviceStatus(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(devicesStatus, predictDevicesStatus) {
+		t.Fatal("failed")
+	}
+}
+
+func TestGetGPUDeviceStatusFromHeader(t *testing.T) {
+	output := `uuid, index, minor_number, name, pstate, fan.speed [%], power.draw [W], power.limit [W], clocks.sm [MHz], memory.total [MiB], memory.used [MiB], memory.free [MiB], ecc.errors.uncorrected.volatile.total, clocks.max.sm [MHz], driver_version
+GPU-66a2874a-837d-cd53-ab26-0d2d842d9822, 0, 1, Tesla P40, P0, [Not Supported], 51.35, 250.00, 1303, 22919, 21227, 1692, 0, 1531, 378.13
+GPU-535c289c-6dd8-e308-b4ca-524b0fc07fa6, 1, 0, Tesla P40, P8, [Not Supported], 9.87, 250.00, 544, 22919, 0, 22919, [N/A], 1531, 378.13
+`
+	devicesStatus, err := getGPUDeviceStatus(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(devicesStatus) != 2 {
+		t.Fatalf("expected 2 devices, got %d", len(devicesStatus))
+	}
+
+	expected := DeviceStatus{
+		Index:       toUintP(0),
+		MinorNumber: toUintP(1),
+		UUID:        "GPU-66a2874a-837d-cd53-ab26-0d2d842d9822",
+		Name:        "Tesla P40",
+		PState:      "P0",
+		FanSpeed:    0,
+		Power: PowerInfo{
+			Draw:  51.35,
+			Limit: 250,
+		},
+		Clocks: ClockInfo{
+			Cores: 1303,
+		},
+		Memory: MemoryInfo{
+			Total:   22919 * mebibyte,
+			Used:    21227 * mebibyte,
+			Free:    1692 * mebibyte,
+			UsedPct: 21227.0 / 22919.0,
+		},
+		Utilization: UtilizationInfo{
+			Memory: 92,
+		},
+		Fields: map[string]QueryField{
+			"clocks.max.sm":  {Value: float64(1531), Unit: "MHz"},
+			"driver_version": {Value: "378.13"},
+		},
+	}
+	if !reflect.DeepEqual(devicesStatus[0], expected) {
+		t.Fatalf("expected %+v, got %+v", expected, devicesStatus[0])
+	}
+
+	if devicesStatus[1].UUID != "GPU-535c289c-6dd8-e308-b4ca-524b0fc07fa6" || devicesStatus[1].PState != "P8" {
+		t.Fatalf("unexpected second device: %+v", devicesStatus[1])
+	}
+}
+
+func TestGetGPUDeviceStatusInvalidValue(t *testing.T) {
+	output := `index, uuid, temperature.gpu, utilization.gpu [%], memory.used [MiB], clocks.max.sm [MHz]
+0, GPU-66a2874a-837d-cd53-ab26-0d2d842d9822, hot, 87, 11449, fast
+1, GPU-535c289c-6dd8-e308-b4ca-524b0fc07fa6, 34, 0
+one, GPU-7e5a2b1c-3f4d-4e6a-9b8c-1d2e3f4a5b6c, 40, 12, 305, 1531
+2, [N/A], 40, 12, 305, 1531
+`
+	devicesStatus, err := getGPUDeviceStatus(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The GPU is reported without the unparsable temperature and clock, and
+	// the line without all columns and the lines without a valid index or
+	// uuid are skipped.
+	if len(devicesStatus) != 1 {
+		t.Fatalf("expected 1 device, got %d", len(devicesStatus))
+	}
+	device := devicesStatus[0]
+	if device.Temperature != 0 || device.Utilization.GPU != 87 || device.Memory.Used != 11449*mebibyte {
+		t.Fatalf("expected the other fields to be parsed, got %+v", device)
+	}
+	if !reflect.DeepEqual(device.InvalidFields, []string{"temperature.gpu", "clocks.max.sm"}) || device.Fields != nil {
+		t.Fatalf("expected temperature.gpu and clocks.max.sm to be invalid, got %v, %v", device.InvalidFields, device.Fields)
+	}
+}
+
+func TestNvidiaSMIQueryGPU(t *testing.T) {
+	query := nvidiaSMIQueryGPU([]string{"power.draw", " index", "fan.speed"})
+	if query != "--query-gpu=index,uuid,pci.bus_id,minor_number,power.draw,fan.speed" {
+		t.Fatalf("unexpected query: %s", query)
+	}
+}
+
+func TestGetComputeProcesses(t *testing.T) {
+	output := `1234, GPU-66a2874a-837d-cd53-ab26-0d2d842d9822, 11449
+5678, GPU-66a2874a-837d-cd53-ab26-0d2d842d9822, 305
+[Not Found], GPU-66a2874a-837d-cd53-ab26-0d2d842d9822, 12
+91011, GPU-535c289c-6dd8-e308-b4ca-524b0fc07fa6, 8025
+`
+	processes, err := getComputeProcesses(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]ProcessInfo{
+		"GPU-66a2874a-837d-cd53-ab26-0d2d842d9822": {
+			{PID: 1234, MemoryUsed: 11449},
+			{PID: 5678, MemoryUsed: 305},
+		},
+		"GPU-535c289c-6dd8-e308-b4ca-524b0fc07fa6": {
+			{PID: 91011, MemoryUsed: 8025},
+		},
+	}
+	if !reflect.DeepEqual(processes, expected) {
+		t.Fatalf("unexpected processes: %v", processes)
+	}
+}
+
+func TestNvidiaSMICommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nvidia-smi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := filepath.Join(dir, "nvidia-smi")
+	content := `#!/bin/sh
+if [ "$1" = "--fail" ]; then
+	echo "NVIDIA-SMI has failed because it couldn't communicate with the NVIDIA driver." >&2
+	exit 9
+fi
+if [ "$1" = "--hang" ]; then
+	exec sleep 10
+fi
+echo "$NVIDIA_SMI_WRAPPED $NVIDIA_SMI_TEST $*"
+`
+	if err := ioutil.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	command := newNvidiaSMICommand(Config{
+		NvidiaSMIPath:    script,
+		NvidiaSMIWrapper: []string{"env", "NVIDIA_SMI_WRAPPED=1"},
+		NvidiaSMIArgs:    []string{"-i", "0"},
+		NvidiaSMIEnv:     []string{"NVIDIA_SMI_TEST=env"},
+		Period:           time.Second,
+	})
+	if command.timeout != time.Second {
+		t.Fatalf("expected the timeout to default to the period, got %v", command.timeout)
+	}
+
+	output, err := command.run("--query-gpu=index", "--format=csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != "1 env -i 0 --query-gpu=index --format=csv\n" {
+		t.Fatalf("unexpected output '%s'", output)
+	}
+
+	command.args = nil
+	if _, err := command.run("--fail"); err == nil || !strings.Contains(err.Error(), "couldn't communicate with the NVIDIA driver") {
+		t.Fatalf("expected the error to include stderr, got %v", err)
+	}
+
+	command.timeout = 100 * time.Millisecond
+	if _, err := command.run("--hang"); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+}
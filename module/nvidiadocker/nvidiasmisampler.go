@@ -0,0 +1,460 @@
+package nvidiadocker
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+const (
+	samplerMinBackoff = time.Second
+	samplerMaxBackoff = time.Minute
+	// samplerStderrSize is how much of the end of the stderr of nvidia-smi is
+	// kept for the error of a failed run.
+	samplerStderrSize = 4096
+)
+
+// samplers are the samplers shared by the metricsets collecting from the
+// same host with the same nvidia-smi settings, so a host runs a single
+// nvidia-smi of each query in loop mode.
+var samplers = struct {
+	sync.Mutex
+	byKey map[string]*nvidiaSMISampler
+}{byKey: map[string]*nvidiaSMISampler{}}
+
+// acquireNvidiaSMISampler returns the shared sampler of the given settings,
+// and creates it for the first metricset. Every acquired sampler must be
+// released.
+func acquireNvidiaSMISampler(command *nvidiaSMICommand, queryGPU string, interval time.Duration) *nvidiaSMISampler {
+	key := fmt.Sprintf("%q %q %q %q %q %v", command.wrapper, command.path, command.args, command.env, queryGPU, interval)
+
+	samplers.Lock()
+	defer samplers.Unlock()
+
+	s, found := samplers.byKey[key]
+	if !found {
+		s = newNvidiaSMISampler(command, queryGPU, interval)
+		s.key = key
+		samplers.byKey[key] = s
+	}
+	s.refs++
+	return s
+}
+
+// releaseNvidiaSMISampler releases an acquired sampler, and closes it when it
+// isn't used anymore.
+func releaseNvidiaSMISampler(s *nvidiaSMISampler) error {
+	samplers.Lock()
+	defer samplers.Unlock()
+
+	s.refs--
+	if s.refs > 0 {
+		return nil
+	}
+	delete(samplers.byKey, s.key)
+	return s.Close()
+}
+
+// nvidiaSMISampler runs nvidia-smi in loop mode, `-lms <interval>`, instead of
+// starting it for every fetch, and keeps the latest sample of every GPU. The
+// compute processes are queried by a second nvidia-smi in loop mode. The
+// processes are restarted with an exponential backoff when they exit.
+type nvidiaSMISampler struct {
+	command  *nvidiaSMICommand
+	queryGPU string
+	interval time.Duration
+	// staleAfter is the age of a sample after which its GPU or process is
+	// not reported anymore, e.g. because it has fallen off the bus or
+	// exited.
+	staleAfter time.Duration
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	// key and refs are guarded by the mutex of samplers.
+	key  string
+	refs int
+
+	startOnce sync.Once
+	ready     chan struct{}
+	readyOnce sync.Once
+
+	mu        sync.Mutex
+	gpuLoop   *nvidiaSMILoop
+	procLoop  *nvidiaSMILoop
+	samples   map[string]deviceSample
+	processes map[processKey]processSample
+	closed    bool
+}
+
+// nvidiaSMILoop is a query nvidia-smi runs in loop mode. Its fields are
+// guarded by the mutex of the sampler.
+type nvidiaSMILoop struct {
+	args    []string
+	read    func(io.Reader) error
+	cmd     *exec.Cmd
+	lastErr error
+}
+
+type deviceSample struct {
+	status DeviceStatus
+	time   time.Time
+}
+
+type processKey struct {
+	uuid string
+	pid  uint
+}
+
+type processSample struct {
+	process ProcessInfo
+	time    time.Time
+}
+
+func newNvidiaSMISampler(command *nvidiaSMICommand, queryGPU string, interval time.Duration) *nvidiaSMISampler {
+	s := &nvidiaSMISampler{
+		command:    command,
+		queryGPU:   queryGPU,
+		interval:   interval,
+		staleAfter: 3 * interval,
+		minBackoff: samplerMinBackoff,
+		maxBackoff: samplerMaxBackoff,
+		ready:      make(chan struct{}),
+		samples:    map[string]deviceSample{},
+		processes:  map[processKey]processSample{},
+	}
+	loopArgs := []string{"-lms", strconv.FormatInt(int64(interval/time.Millisecond), 10)}
+	s.gpuLoop = &nvidiaSMILoop{
+		args: append([]string{queryGPU, nvidiaSMIFormatHeader}, loopArgs...),
+		read: s.readSamples,
+	}
+	s.procLoop = &nvidiaSMILoop{
+		args: append([]string{nvidiaSMIQueryComputeApps, nvidiaSMIFormatNoUnits}, loopArgs...),
+		read: s.readProcesses,
+	}
+	return s
+}
+
+// start starts both loops on the first call and waits up to the command
+// timeout for the first GPU samples.
+func (s *nvidiaSMISampler) start() {
+	s.startOnce.Do(func() {
+		go s.run(s.gpuLoop)
+		go s.run(s.procLoop)
+
+		wait := s.command.timeout
+		if wait <= 0 {
+			wait = s.interval
+		}
+		select {
+		case <-s.ready:
+		case <-time.After(wait):
+		}
+	})
+}
+
+// DeviceStatuses returns the latest sample of every GPU ordered by index. The
+// first call starts nvidia-smi and waits up to the command timeout for the
+// first samples.
+func (s *nvidiaSMISampler) DeviceStatuses() ([]DeviceStatus, error) {
+	s.start()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	deviceStatuses := make([]DeviceStatus, 0, len(s.samples))
+	for _, sample := range s.samples {
+		if now.Sub(sample.time) <= s.staleAfter {
+			deviceStatuses = append(deviceStatuses, sample.status)
+		}
+	}
+	if len(deviceStatuses) == 0 {
+		if s.gpuLoop.lastErr != nil {
+			return nil, s.gpuLoop.lastErr
+		}
+		return nil, errors.New("no GPU samples from nvidia-smi")
+	}
+
+	sort.Sort(deviceStatusesByIndex(deviceStatuses))
+	return deviceStatuses, nil
+}
+
+// ComputeProcesses returns the compute processes seen in the last two
+// intervals keyed by the UUID of their GPU. nvidia-smi writes nothing for a
+// loop without processes, so the processes which weren't seen for two
+// intervals are taken as exited.
+func (s *nvidiaSMISampler) ComputeProcesses() (map[string][]ProcessInfo, error) {
+	s.start()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.procLoop.lastErr != nil {
+		return nil, s.procLoop.lastErr
+	}
+
+	now := time.Now()
+	keys := make([]processKey, 0, len(s.processes))
+	for key, sample := range s.processes {
+		if now.Sub(sample.time) > 2*s.interval {
+			delete(s.processes, key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Sort(processKeys(keys))
+
+	processes := make(map[string][]ProcessInfo)
+	for _, key := range keys {
+		processes[key.uuid] = append(processes[key.uuid], s.processes[key].process)
+	}
+	return processes, nil
+}
+
+// Close kills nvidia-smi and stops restarting it. Metricbeat doesn't close
+// its metricsets, so this is only reached from the tests. In the beat,
+// nvidia-smi is killed through Pdeathsig when the beat exits, which is only
+// supported on Linux.
+func (s *nvidiaSMISampler) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	var err error
+	for _, loop := range []*nvidiaSMILoop{s.gpuLoop, s.procLoop} {
+		if loop.cmd != nil && loop.cmd.Process != nil {
+			if killErr := loop.cmd.Process.Kill(); killErr != nil {
+				err = killErr
+			}
+		}
+	}
+	return err
+}
+
+func (s *nvidiaSMISampler) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *nvidiaSMISampler) run(loop *nvidiaSMILoop) {
+	backoff := s.minBackoff
+	for !s.isClosed() {
+		started := time.Now()
+		err := s.sample(loop)
+		if s.isClosed() {
+			return
+		}
+		if err == nil {
+			err = errors.New("nvidia-smi exited")
+		}
+
+		s.mu.Lock()
+		loop.lastErr = err
+		s.mu.Unlock()
+
+		// A process which ran for a while failed for a new reason, so it is
+		// restarted quickly again.
+		if time.Since(started) > s.maxBackoff {
+			backoff = s.minBackoff
+		}
+		logp.Warn("nvidiadocker: nvidia-smi sampler stopped, restarting in %v: %v", backoff, err)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > s.maxBackoff {
+			backoff = s.maxBackoff
+		}
+	}
+}
+
+// sample runs nvidia-smi until it exits and records its samples.
+func (s *nvidiaSMISampler) sample(loop *nvidiaSMILoop) error {
+	cmd := s.command.command(context.Background(), loop.args...)
+	setPdeathsig(cmd)
+
+	stderr := &tailBuffer{size: samplerStderrSize}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	if err := cmd.Start(); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	loop.cmd = cmd
+	if loop == s.procLoop {
+		// An empty loop is written as nothing, so a running process loop
+		// has no error.
+		loop.lastErr = nil
+	}
+	s.mu.Unlock()
+
+	readErr := loop.read(stdout)
+	if readErr != nil {
+		cmd.Process.Kill()
+	}
+	waitErr := cmd.Wait()
+
+	switch {
+	case readErr != nil:
+		return readErr
+	case waitErr != nil && stderr.String() != "":
+		return fmt.Errorf("%s failed: %v: %s", s.command.path, waitErr, stderr.String())
+	case waitErr != nil:
+		return fmt.Errorf("%s failed: %v", s.command.path, waitErr)
+	}
+	return nil
+}
+
+// readSamples parses the samples written by nvidia-smi. The header is only
+// written once, and every interval a line is written per GPU. The samples of
+// a loop are published once its lines are read, so a fetch doesn't see a mix
+// of two loops.
+func (s *nvidiaSMISampler) readSamples(stdout io.Reader) error {
+	var (
+		reader  = bufio.NewReader(stdout)
+		columns []nvidiaSMIColumn
+		loop    []DeviceStatus
+	)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		record, err := parseCSVLine(line)
+		if err != nil {
+			logp.Debug("nvidiadocker", "skipping nvidia-smi output '%s': %v", line, err)
+			continue
+		}
+
+		switch {
+		case columns == nil || isNvidiaSMIHeader(record):
+			columns = parseNvidiaSMIHeader(record)
+		case len(record) != len(columns):
+			logp.Debug("nvidiadocker", "skipping nvidia-smi output '%s' with %d instead of %d columns", line, len(record), len(columns))
+		default:
+			if deviceStatus, ok := parseNvidiaSMIRecord(columns, record); ok {
+				loop = append(loop, deviceStatus)
+			}
+		}
+
+		// The lines of a loop are written at once, so the loop is complete
+		// when all written lines are read.
+		if reader.Buffered() == 0 && len(loop) > 0 {
+			s.publish(loop, time.Now())
+			loop = nil
+		}
+	}
+}
+
+func (s *nvidiaSMISampler) publish(deviceStatuses []DeviceStatus, now time.Time) {
+	s.mu.Lock()
+	for _, deviceStatus := range deviceStatuses {
+		s.samples[deviceStatus.UUID] = deviceSample{status: deviceStatus, time: now}
+	}
+	s.gpuLoop.lastErr = nil
+	s.mu.Unlock()
+
+	s.readyOnce.Do(func() { close(s.ready) })
+}
+
+// readProcesses records the compute processes written by nvidia-smi, a line
+// per process.
+func (s *nvidiaSMISampler) readProcesses(stdout io.Reader) error {
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		uuid, process, ok := parseComputeProcess(scanner.Text())
+		if !ok {
+			continue
+		}
+		s.mu.Lock()
+		s.processes[processKey{uuid: uuid, pid: process.PID}] = processSample{process: process, time: time.Now()}
+		s.mu.Unlock()
+	}
+	return scanner.Err()
+}
+
+func parseCSVLine(line string) ([]string, error) {
+	reader := csv.NewReader(strings.NewReader(line))
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+	return reader.Read()
+}
+
+// isNvidiaSMIHeader returns true for the header line, which starts with the
+// always queried index field.
+func isNvidiaSMIHeader(record []string) bool {
+	return len(record) > 0 && strings.TrimSpace(record[0]) == requiredQueryGPUFields[0]
+}
+
+// tailBuffer keeps the last bytes written to it.
+type tailBuffer struct {
+	mu   sync.Mutex
+	size int
+	buf  []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.size {
+		b.buf = b.buf[len(b.buf)-b.size:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.TrimSpace(string(b.buf))
+}
+
+type deviceStatusesByIndex []DeviceStatus
+
+func (d deviceStatusesByIndex) Len() int      { return len(d) }
+func (d deviceStatusesByIndex) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d deviceStatusesByIndex) Less(i, j int) bool {
+	if d[i].Index == nil || d[j].Index == nil {
+		return d[i].Index != nil
+	}
+	return *d[i].Index < *d[j].Index
+}
+
+type processKeys []processKey
+
+func (k processKeys) Len() int      { return len(k) }
+func (k processKeys) Swap(i, j int) { k[i], k[j] = k[j], k[i] }
+func (k processKeys) Less(i, j int) bool {
+	if k[i].uuid != k[j].uuid {
+		return k[i].uuid < k[j].uuid
+	}
+	return k[i].pid < k[j].pid
+}
@@ -0,0 +1,157 @@
+package nvidiadocker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNvidiaSMISampler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nvidia-smi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The fake nvidia-smi writes the header once and two GPUs per loop, and
+	// exits after three loops. The utilization counts the runs. The compute
+	// apps query writes a process on GPU-1 until it is killed.
+	runs := filepath.Join(dir, "runs")
+	script := filepath.Join(dir, "nvidia-smi")
+	content := `#!/bin/sh
+case "$*" in
+*--query-compute-apps*)
+	while true; do
+		echo "1234, GPU-1, 512"
+		sleep 0.05
+	done
+	;;
+esac
+echo run >> ` + runs + `
+run=$(wc -l < ` + runs + `)
+echo "$*" > ` + filepath.Join(dir, "args") + `
+echo "index, uuid, utilization.gpu [%]"
+for loop in 1 2 3; do
+	printf "0, GPU-0, $run\n1, GPU-1, $run\n"
+	sleep 0.05
+done
+`
+	if err := ioutil.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	command := newNvidiaSMICommand(Config{NvidiaSMIPath: script, Period: time.Second})
+	sampler := newNvidiaSMISampler(command, "--query-gpu=index,uuid,utilization.gpu", 50*time.Millisecond)
+	sampler.minBackoff = 10 * time.Millisecond
+	sampler.maxBackoff = 20 * time.Millisecond
+	defer sampler.Close()
+
+	deviceStatuses, err := sampler.DeviceStatuses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deviceStatuses) != 2 || *deviceStatuses[0].Index != 0 || deviceStatuses[1].UUID != "GPU-1" {
+		t.Fatalf("expected the samples of both GPUs, got %+v", deviceStatuses)
+	}
+
+	processes, err := sampler.ComputeProcesses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(processes["GPU-1"]) != 1 || processes["GPU-1"][0].PID != 1234 || processes["GPU-1"][0].MemoryUsed != 512 {
+		t.Fatalf("expected the process on GPU-1, got %+v", processes)
+	}
+
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(string(args)), "-lms 50") {
+		t.Fatalf("expected nvidia-smi to run in loop mode, got %s", args)
+	}
+
+	// The sampler restarts nvidia-smi when it exits.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		deviceStatuses, err := sampler.DeviceStatuses()
+		if err == nil && deviceStatuses[0].Utilization.GPU >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected samples of a restarted nvidia-smi, got %+v, %v", deviceStatuses, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := sampler.Close(); err != nil && !strings.Contains(err.Error(), "process already finished") {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	content, _ = readString(runs)
+	time.Sleep(200 * time.Millisecond)
+	if after, _ := readString(runs); after != content {
+		t.Fatal("expected nvidia-smi not to be restarted after close")
+	}
+}
+
+func TestNvidiaSMISamplerFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nvidia-smi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := filepath.Join(dir, "nvidia-smi")
+	content := `#!/bin/sh
+echo "NVIDIA-SMI has failed because it couldn't communicate with the NVIDIA driver." >&2
+exit 9
+`
+	if err := ioutil.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	command := newNvidiaSMICommand(Config{NvidiaSMIPath: script, Period: 200 * time.Millisecond})
+	sampler := newNvidiaSMISampler(command, "--query-gpu=index,uuid", 50*time.Millisecond)
+	defer sampler.Close()
+
+	if _, err := sampler.DeviceStatuses(); err == nil || !strings.Contains(err.Error(), "couldn't communicate with the NVIDIA driver") {
+		t.Fatalf("expected the error of nvidia-smi, got %v", err)
+	}
+}
+
+func TestAcquireNvidiaSMISampler(t *testing.T) {
+	command := newNvidiaSMICommand(Config{NvidiaSMIPath: "/bin/false", Period: time.Second})
+	first := acquireNvidiaSMISampler(command, "--query-gpu=index,uuid", time.Second)
+	second := acquireNvidiaSMISampler(newNvidiaSMICommand(Config{NvidiaSMIPath: "/bin/false", Period: time.Second}), "--query-gpu=index,uuid", time.Second)
+	other := acquireNvidiaSMISampler(command, "--query-gpu=index,uuid", 2*time.Second)
+	defer releaseNvidiaSMISampler(other)
+
+	if first != second {
+		t.Fatal("expected the sampler of the same settings to be shared")
+	}
+	if first == other {
+		t.Fatal("expected a sampler per interval")
+	}
+
+	releaseNvidiaSMISampler(first)
+	if first.isClosed() {
+		t.Fatal("expected the sampler to be kept while it is used")
+	}
+	releaseNvidiaSMISampler(second)
+	if !first.isClosed() {
+		t.Fatal("expected the sampler to be closed by the last release")
+	}
+	if third := acquireNvidiaSMISampler(command, "--query-gpu=index,uuid", time.Second); third == first {
+		t.Fatal("expected a new sampler after the last release")
+	} else {
+		releaseNvidiaSMISampler(third)
+	}
+}
+
+func readString(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	return string(content), err
+}
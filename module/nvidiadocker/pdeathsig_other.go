@@ -0,0 +1,9 @@
+// +build !linux
+
+package nvidiadocker
+
+import "os/exec"
+
+// setPdeathsig is only supported on Linux. Elsewhere nvidia-smi started in
+// loop mode keeps running after the beat exits.
+func setPdeathsig(cmd *exec.Cmd) {}
@@ -0,0 +1,216 @@
+package nvidiadocker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pluginGPUInfoPath    = "/v1.0/gpu/info/json"
+	pluginGPUStatusPath  = "/v1.0/gpu/status/json"
+	pluginRequestTimeout = 10 * time.Second
+)
+
+type (
+	// pluginBackend reads the GPU status from the REST API of nvidia-docker-plugin.
+	pluginBackend struct {
+		apiURL     string
+		httpClient *http.Client
+
+		mu      sync.Mutex
+		devices []pluginDeviceInfo
+	}
+
+	pluginGPUInfo struct {
+		Devices []pluginDeviceInfo
+	}
+
+	pluginDeviceInfo struct {
+		UUID  string
+		Path  string
+		Model *string
+		Power *uint
+		PCI   struct {
+			BusID string
+		}
+		Memory struct {
+			Global *uint64
+		}
+	}
+
+	pluginGPUStatus struct {
+		Devices []pluginDeviceStatus
+	}
+
+	pluginDeviceStatus struct {
+		Power       *uint
+		Temperature *uint
+		Utilization struct {
+			GPU     *uint
+			Memory  *uint
+			Encoder *uint
+			Decoder *uint
+		}
+		Memory struct {
+			GlobalUsed *uint64
+		}
+		Clocks struct {
+			Cores  *uint
+			Memory *uint
+		}
+		PCI struct {
+			BAR1Used   *uint64
+			Throughput struct {
+				RX *uint
+				TX *uint
+			}
+		}
+		Processes []struct {
+			PID        uint
+			Name       string
+			MemoryUsed uint64
+		}
+	}
+)
+
+func newPluginBackend(apiURL string) (*pluginBackend, error) {
+	if apiURL == "" {
+		return nil, fmt.Errorf("apiurl is required for the '%s' gpubackend", pluginBackendName)
+	}
+	if _, err := url.Parse(apiURL); err != nil {
+		return nil, fmt.Errorf("invalid apiurl '%s': %v", apiURL, err)
+	}
+
+	return &pluginBackend{
+		apiURL:     strings.TrimSuffix(apiURL, "/"),
+		httpClient: &http.Client{Timeout: pluginRequestTimeout},
+	}, nil
+}
+
+func (b *pluginBackend) DeviceStatuses() ([]DeviceStatus, error) {
+	devices, err := b.deviceInfos()
+	if err != nil {
+		return nil, err
+	}
+
+	var status pluginGPUStatus
+	if err := b.getJSON(pluginGPUStatusPath, &status); err != nil {
+		return nil, err
+	}
+
+	return toDeviceStatuses(devices, status.Devices), nil
+}
+
+// deviceInfos returns the static device information of the host. It is
+// requested once and cached, as it doesn't change while the plugin runs.
+func (b *pluginBackend) deviceInfos() ([]pluginDeviceInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.devices != nil {
+		return b.devices, nil
+	}
+
+	var info pluginGPUInfo
+	if err := b.getJSON(pluginGPUInfoPath, &info); err != nil {
+		return nil, err
+	}
+	b.devices = info.Devices
+	return b.devices, nil
+}
+
+func (b *pluginBackend) getJSON(path string, v interface{}) error {
+	resp, err := b.httpClient.Get(b.apiURL + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP error %d in %s: %s", resp.StatusCode, path, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func toDeviceStatuses(infos []pluginDeviceInfo, statuses []pluginDeviceStatus) []DeviceStatus {
+	deviceStatuses := make([]DeviceStatus, 0, len(statuses))
+	for i, status := range statuses {
+		deviceStatus := DeviceStatus{
+			Index:       toUintP(uint(i)),
+			Temperature: uintValue(status.Temperature),
+			Power: PowerInfo{
+				Draw: float64(uintValue(status.Power)),
+			},
+			Utilization: UtilizationInfo{
+				GPU:              uintValue(status.Utilization.GPU),
+				MemoryController: uintValue(status.Utilization.Memory),
+				Encoder:          uintValue(status.Utilization.Encoder),
+				Decoder:          uintValue(status.Utilization.Decoder),
+			},
+			Memory: MemoryInfo{
+				Used: uint64Value(status.Memory.GlobalUsed) * mebibyte,
+			},
+			Clocks: ClockInfo{
+				Cores:  uintValue(status.Clocks.Cores),
+				Memory: uintValue(status.Clocks.Memory),
+			},
+			PCI: PCIInfo{
+				BAR1Used: uint64Value(status.PCI.BAR1Used),
+				RX:       uintValue(status.PCI.Throughput.RX),
+				TX:       uintValue(status.PCI.Throughput.TX),
+			},
+		}
+
+		if i < len(infos) {
+			info := infos[i]
+			deviceStatus.UUID = info.UUID
+			deviceStatus.PCI.BusID = info.PCI.BusID
+			if minorNumber, ok := parseNvidiaDeviceMinor(info.Path); ok {
+				deviceStatus.MinorNumber = toUintP(minorNumber)
+			}
+			deviceStatus.Power.Limit = float64(uintValue(info.Power))
+			deviceStatus.Memory.Total = uint64Value(info.Memory.Global) * mebibyte
+			if info.Model != nil {
+				deviceStatus.Name = *info.Model
+			}
+		}
+
+		// The plugin's own Utilization.Memory is the memory controller load,
+		// Utilization.Memory is the used share of the device memory.
+		if deviceStatus.Memory.Total >= deviceStatus.Memory.Used {
+			deviceStatus.Memory.Free = deviceStatus.Memory.Total - deviceStatus.Memory.Used
+		}
+		setMemoryUsage(&deviceStatus)
+
+		for _, process := range status.Processes {
+			deviceStatus.Processes = append(deviceStatus.Processes, ProcessInfo{
+				PID:        process.PID,
+				Name:       process.Name,
+				MemoryUsed: process.MemoryUsed,
+			})
+		}
+
+		deviceStatuses = append(deviceStatuses, deviceStatus)
+	}
+	return deviceStatuses
+}
+
+func uintValue(val *uint) uint {
+	if val == nil {
+		return 0
+	}
+	return *val
+}
+
+func uint64Value(val *uint64) uint64 {
+	if val == nil {
+		return 0
+	}
+	return *val
+}
@@ -0,0 +1,65 @@
+package nvidiadocker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const (
+	testPluginInfoJSON   = `{"Version":{"Driver":"378.13","CUDA":"8.0"},"Devices":[{"UUID":"GPU-66a2874a-837d-cd53-ab26-0d2d842d9822","Path":"/dev/nvidia0","Model":"Tesla P40","Power":250,"PCI":{"BusID":"0000:08:00.0","BAR1":32768,"Bandwidth":15760},"Memory":{"ECC":true,"Global":22912}},{"UUID":"GPU-535c289c-6dd8-e308-b4ca-524b0fc07fa6","Path":"/dev/nvidia1","Model":"Tesla P40","Power":250,"PCI":{"BusID":"0000:0B:00.0","BAR1":32768,"Bandwidth":15760},"Memory":{"ECC":true,"Global":22912}}]}`
+	testPluginStatusJSON = `{"Devices":[{"Power":13,"Temperature":15,"Utilization":{"GPU":10,"Memory":293,"Encoder":0,"Decoder":0},"Memory":{"GlobalUsed":11456,"ECCErrors":{"L1Cache":null,"L2Cache":null,"Global":null}},"Clocks":{"Cores":40,"Memory":405},"PCI":{"BAR1Used":2,"Throughput":{"RX":0,"TX":0}},"Processes":[{"PID":1234,"Name":"python","MemoryUsed":11449}]},{"Power":9,"Temperature":14,"Utilization":{"GPU":45,"Memory":0,"Encoder":0,"Decoder":0},"Memory":{"GlobalUsed":7,"ECCErrors":{"L1Cache":null,"L2Cache":null,"Global":null}},"Clocks":{"Cores":40,"Memory":405},"PCI":{"BAR1Used":2,"Throughput":{"RX":0,"TX":0}},"Processes":null}]}`
+)
+
+func TestPluginBackendDeviceStatuses(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(pluginGPUInfoPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testPluginInfoJSON))
+	})
+	mux.HandleFunc(pluginGPUStatusPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testPluginStatusJSON))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	backend, err := newPluginBackend(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	devices, err := backend.DeviceStatuses()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(devices) != 2 {
+		t.Fatalf("expected 2 devices, got %d", len(devices))
+	}
+
+	device := devices[0]
+	if *device.Index != 0 || device.UUID != "GPU-66a2874a-837d-cd53-ab26-0d2d842d9822" {
+		t.Fatalf("unexpected device identity: %d %s", *device.Index, device.UUID)
+	}
+	if device.MinorNumber == nil || *device.MinorNumber != 0 || devices[1].MinorNumber == nil || *devices[1].MinorNumber != 1 {
+		t.Fatalf("expected the minor numbers of the device paths: %+v", devices)
+	}
+	if device.Temperature != 15 || device.Power.Draw != 13 || device.Power.Limit != 250 || device.Utilization.GPU != 10 {
+		t.Fatalf("unexpected device status: %+v", device)
+	}
+	if device.Memory.Used != 11456*mebibyte || device.Memory.Total != 22912*mebibyte || device.Memory.UsedPct != 0.5 || device.Utilization.Memory != 50 {
+		t.Fatalf("unexpected memory status: %+v", device.Memory)
+	}
+	if device.Name != "Tesla P40" || device.Utilization.MemoryController != 293 {
+		t.Fatalf("unexpected device name or memory controller load: %+v", device)
+	}
+	if device.PCI.BusID != "0000:08:00.0" || device.Clocks.Memory != 405 {
+		t.Fatalf("unexpected PCI or clock status: %+v", device)
+	}
+	if len(device.Processes) != 1 || device.Processes[0].PID != 1234 {
+		t.Fatalf("unexpected processes: %+v", device.Processes)
+	}
+
+	if *devices[1].Index != 1 || devices[1].Utilization.GPU != 45 {
+		t.Fatalf("unexpected second device: %+v", devices[1])
+	}
+}
@@ -0,0 +1,75 @@
+package nvidiadocker
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	cgroupContainerIDRegexp = regexp.MustCompile("[0-9a-f]{64}")
+
+	// errNoProcPath is returned for the processes of a remote host, which
+	// can't be resolved without its proc filesystem.
+	errNoProcPath = errors.New("no proc filesystem")
+)
+
+// ContainerProcess is a GPU compute process together with the device it runs on.
+type ContainerProcess struct {
+	Device  *DeviceStatus
+	Process ProcessInfo
+}
+
+// ContainerProcesses resolves the compute processes of the given devices to the
+// containers they run in and returns them keyed by container ID. Processes
+// which don't run in a container are left out.
+func ContainerProcesses(procPath string, gpuDevices []DeviceStatus) map[string][]ContainerProcess {
+	containerProcesses := make(map[string][]ContainerProcess)
+	for i := range gpuDevices {
+		device := &gpuDevices[i]
+		for _, process := range device.Processes {
+			containerID, err := ContainerIDFromPID(procPath, process.PID)
+			if err != nil || containerID == "" {
+				continue
+			}
+			containerProcesses[containerID] = append(containerProcesses[containerID], ContainerProcess{
+				Device:  device,
+				Process: process,
+			})
+		}
+	}
+	return containerProcesses
+}
+
+// ContainerIDFromPID returns the ID of the container the process runs in, read
+// from /proc/<pid>/cgroup. An empty ID is returned for host processes. Without
+// a procPath, processes can't be resolved.
+func ContainerIDFromPID(procPath string, pid uint) (string, error) {
+	if procPath == "" {
+		return "", errNoProcPath
+	}
+	content, err := ioutil.ReadFile(filepath.Join(procPath, strconv.FormatUint(uint64(pid), 10), "cgroup"))
+	if err != nil {
+		return "", err
+	}
+	return containerIDFromCgroup(string(content)), nil
+}
+
+// containerIDFromCgroup finds the container ID in the cgroup paths of a process,
+// e.g. /docker/<id>, /system.slice/docker-<id>.scope or /kubepods/<pod>/<id>.
+func containerIDFromCgroup(content string) string {
+	for _, line := range strings.Split(strings.TrimSpace(content), "\n") {
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+
+		if ids := cgroupContainerIDRegexp.FindAllString(fields[2], -1); len(ids) > 0 {
+			return ids[len(ids)-1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,88 @@
+package nvidiadocker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestContainerIDFromCgroup(t *testing.T) {
+	tests := []struct {
+		Cgroup      string
+		ContainerID string
+	}{
+		{
+			Cgroup:      "12:devices:/docker/4e3bb646c7ff48078295daccfdbc5a34d3e0a52b2e6e87ba9c1f7e3f9e8d4b21\n1:name=systemd:/docker/4e3bb646c7ff48078295daccfdbc5a34d3e0a52b2e6e87ba9c1f7e3f9e8d4b21\n",
+			ContainerID: "4e3bb646c7ff48078295daccfdbc5a34d3e0a52b2e6e87ba9c1f7e3f9e8d4b21",
+		},
+		{
+			Cgroup:      "0::/system.slice/docker-ca766152aa55425fb6fcb84319732915ca766152aa55425fb6fcb84319732915.scope\n",
+			ContainerID: "ca766152aa55425fb6fcb84319732915ca766152aa55425fb6fcb84319732915",
+		},
+		{
+			Cgroup:      "11:memory:/kubepods/burstable/pod535c289c-6dd8-e308-b4ca-524b0fc07fa6/149648d87e32715ab5c3fe6df5976c7e149648d87e32715ab5c3fe6df5976c7e\n",
+			ContainerID: "149648d87e32715ab5c3fe6df5976c7e149648d87e32715ab5c3fe6df5976c7e",
+		},
+		{
+			Cgroup:      "12:devices:/user.slice\n1:name=systemd:/user.slice/user-1000.slice/session-2.scope\n",
+			ContainerID: "",
+		},
+	}
+
+	for _, test := range tests {
+		if containerID := containerIDFromCgroup(test.Cgroup); containerID != test.ContainerID {
+			t.Fatalf("expected '%s', got '%s'", test.ContainerID, containerID)
+		}
+	}
+}
+
+func TestContainerProcesses(t *testing.T) {
+	procPath, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(procPath)
+
+	containerID := "4e3bb646c7ff48078295daccfdbc5a34d3e0a52b2e6e87ba9c1f7e3f9e8d4b21"
+	writeCgroup := func(pid, content string) {
+		if err := os.MkdirAll(filepath.Join(procPath, pid), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(procPath, pid, "cgroup"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeCgroup("100", "12:devices:/docker/"+containerID+"\n")
+	writeCgroup("200", "12:devices:/user.slice\n")
+
+	gpuDevices := []DeviceStatus{
+		{
+			Index: toUintP(0),
+			Processes: []ProcessInfo{
+				{PID: 100, MemoryUsed: 1024},
+				{PID: 200, MemoryUsed: 512},
+				{PID: 300, MemoryUsed: 256},
+			},
+		},
+		{
+			Index: toUintP(1),
+			Processes: []ProcessInfo{
+				{PID: 100, MemoryUsed: 2048},
+			},
+		},
+	}
+
+	containerProcesses := ContainerProcesses(procPath, gpuDevices)
+	if len(containerProcesses) != 1 {
+		t.Fatalf("expected processes of one container, got %v", containerProcesses)
+	}
+
+	processes := containerProcesses[containerID]
+	if len(processes) != 2 {
+		t.Fatalf("expected 2 processes, got %d", len(processes))
+	}
+	if *processes[1].Device.Index != 1 || processes[1].Process.MemoryUsed != 2048 {
+		t.Fatalf("unexpected process: %+v", processes[1])
+	}
+}
@@ -0,0 +1,245 @@
+package nvidiadocker
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+const (
+	prometheusPath        = "/metrics"
+	prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+	// prometheusLabelPrefix prefixes the whitelisted container labels, so
+	// they don't collide with the labels set by the exporter.
+	prometheusLabelPrefix = "label_"
+)
+
+var (
+	prometheusInvalidLabelChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+	prometheusExportersMu sync.Mutex
+	// prometheusExporters are shared by the metricsets of the module, which
+	// each unpack the module configuration, by their listen address. The
+	// metricsets of all hosts share an exporter.
+	prometheusExporters = map[string]*PrometheusExporter{}
+)
+
+// PrometheusLabel is a label of a Prometheus sample.
+type PrometheusLabel struct {
+	Name  string
+	Value string
+}
+
+// PrometheusSample is a single value of a Prometheus gauge.
+type PrometheusSample struct {
+	Name   string
+	Help   string
+	Labels []PrometheusLabel
+	Value  float64
+}
+
+// PrometheusExporter serves the latest samples of the metricsets in the
+// Prometheus text exposition format. A nil exporter discards all samples.
+type PrometheusExporter struct {
+	labels []string
+
+	mu      sync.RWMutex
+	samples map[string][]PrometheusSample
+}
+
+// NewPrometheusExporter returns the exporter listening on the configured
+// address and starts it on first use. It returns nil if no address is
+// configured.
+func NewPrometheusExporter(cfg Config) (*PrometheusExporter, error) {
+	if cfg.PrometheusListen == "" {
+		return nil, nil
+	}
+
+	prometheusExportersMu.Lock()
+	defer prometheusExportersMu.Unlock()
+
+	if exporter, found := prometheusExporters[cfg.PrometheusListen]; found {
+		return exporter, nil
+	}
+
+	listener, err := net.Listen("tcp", cfg.PrometheusListen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s for prometheus: %v", cfg.PrometheusListen, err)
+	}
+
+	exporter := newPrometheusExporter(cfg.PrometheusLabels)
+	mux := http.NewServeMux()
+	mux.Handle(prometheusPath, exporter)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			logp.Err("nvidiadocker: prometheus exporter on %s stopped: %v", cfg.PrometheusListen, err)
+		}
+	}()
+
+	prometheusExporters[cfg.PrometheusListen] = exporter
+	return exporter, nil
+}
+
+func newPrometheusExporter(labels []string) *PrometheusExporter {
+	return &PrometheusExporter{
+		labels:  labels,
+		samples: map[string][]PrometheusSample{},
+	}
+}
+
+// Update replaces the samples of a metricset collecting from a host with the
+// samples of its latest fetch. The samples are labeled with the host.
+func (e *PrometheusExporter) Update(metricset string, host string, samples []PrometheusSample) {
+	if e == nil {
+		return
+	}
+
+	hostLabel := PrometheusLabel{Name: "host", Value: host}
+	for i := range samples {
+		samples[i].Labels = append([]PrometheusLabel{hostLabel}, samples[i].Labels...)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.samples[metricset+"/"+host] = samples
+}
+
+// ContainerLabels returns the labels identifying a container together with its
+// whitelisted container labels.
+func (e *PrometheusExporter) ContainerLabels(id, name string, labels map[string]string) []PrometheusLabel {
+	if e == nil {
+		return nil
+	}
+
+	promLabels := []PrometheusLabel{
+		{Name: "container_id", Value: id},
+		{Name: "container_name", Value: name},
+	}
+	for _, label := range e.labels {
+		if value, found := labels[label]; found {
+			promLabels = append(promLabels, PrometheusLabel{
+				Name:  prometheusLabelPrefix + prometheusInvalidLabelChars.ReplaceAllString(label, "_"),
+				Value: value,
+			})
+		}
+	}
+	return promLabels
+}
+
+// GPULabels returns the labels identifying a GPU.
+func GPULabels(index interface{}, uuid string) []PrometheusLabel {
+	return []PrometheusLabel{
+		{Name: "gpu_index", Value: fmt.Sprint(index)},
+		{Name: "gpu_uuid", Value: uuid},
+	}
+}
+
+// EventSample returns the sample of a numeric value of an event, or false if
+// the event doesn't have the value.
+func EventSample(event common.MapStr, key string, name string, help string, labels []PrometheusLabel) (PrometheusSample, bool) {
+	value, err := event.GetValue(key)
+	if err != nil {
+		return PrometheusSample{}, false
+	}
+
+	var floatValue float64
+	switch v := value.(type) {
+	case float64:
+		floatValue = v
+	case int:
+		floatValue = float64(v)
+	case int64:
+		floatValue = float64(v)
+	case uint:
+		floatValue = float64(v)
+	case uint64:
+		floatValue = float64(v)
+	default:
+		return PrometheusSample{}, false
+	}
+
+	return PrometheusSample{
+		Name:   name,
+		Help:   help,
+		Labels: labels,
+		Value:  floatValue,
+	}, true
+}
+
+func (e *PrometheusExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	writePrometheusText(&buf, e.allSamples())
+
+	w.Header().Set("Content-Type", prometheusContentType)
+	w.Write(buf.Bytes())
+}
+
+// allSamples returns the samples of all metricsets and hosts ordered by name,
+// keeping the order of the samples with the same name.
+func (e *PrometheusExporter) allSamples() []PrometheusSample {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	metricsets := make([]string, 0, len(e.samples))
+	for metricset := range e.samples {
+		metricsets = append(metricsets, metricset)
+	}
+	sort.Strings(metricsets)
+
+	var samples []PrometheusSample
+	for _, metricset := range metricsets {
+		samples = append(samples, e.samples[metricset]...)
+	}
+	sort.Stable(samplesByName(samples))
+	return samples
+}
+
+// writePrometheusText writes the samples, which must be ordered by name, in
+// the Prometheus text exposition format.
+func writePrometheusText(w io.Writer, samples []PrometheusSample) {
+	for i, sample := range samples {
+		if i == 0 || samples[i-1].Name != sample.Name {
+			fmt.Fprintf(w, "# HELP %s %s\n", sample.Name, escapePrometheusHelp(sample.Help))
+			fmt.Fprintf(w, "# TYPE %s gauge\n", sample.Name)
+		}
+
+		fmt.Fprint(w, sample.Name)
+		if len(sample.Labels) > 0 {
+			labels := make([]string, 0, len(sample.Labels))
+			for _, label := range sample.Labels {
+				labels = append(labels, label.Name+"=\""+escapePrometheusLabelValue(label.Value)+"\"")
+			}
+			fmt.Fprintf(w, "{%s}", strings.Join(labels, ","))
+		}
+		fmt.Fprintf(w, " %s\n", strconv.FormatFloat(sample.Value, 'g', -1, 64))
+	}
+}
+
+var (
+	prometheusHelpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	prometheusLabelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapePrometheusHelp(help string) string {
+	return prometheusHelpEscaper.Replace(help)
+}
+
+func escapePrometheusLabelValue(value string) string {
+	return prometheusLabelValueEscaper.Replace(value)
+}
+
+type samplesByName []PrometheusSample
+
+func (s samplesByName) Len() int           { return len(s) }
+func (s samplesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s samplesByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
@@ -0,0 +1,81 @@
+package nvidiadocker
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/elastic/beats/libbeat/common"
+)
+
+func TestPrometheusExporter(t *testing.T) {
+	exporter := newPrometheusExporter([]string{"com.example.team", "missing"})
+
+	containerLabels := exporter.ContainerLabels("id1", "name1", map[string]string{
+		"com.example.team": "ml \"research\"",
+		"maintainer":       "NVIDIA CORPORATION <cudatools@nvidia.com>",
+	})
+	labels := append(containerLabels, GPULabels(uint(0), "GPU-66a2874a-837d-cd53-ab26-0d2d842d9822")...)
+
+	event := common.MapStr{"utilization": common.MapStr{"gpu": uint(45)}, "name": "Tesla P40"}
+	sample, ok := EventSample(event, "utilization.gpu", "nvidiadocker_container_gpu_utilization_percent", "Utilization of a GPU assigned to the container.", labels)
+	if !ok {
+		t.Fatal("expected a sample of the utilization")
+	}
+	if _, ok := EventSample(event, "name", "name", "", nil); ok {
+		t.Fatal("expected no sample of a string value")
+	}
+	if _, ok := EventSample(event, "temperature", "temperature", "", nil); ok {
+		t.Fatal("expected no sample of a missing value")
+	}
+
+	exporter.Update("status", "gpu-1", []PrometheusSample{sample})
+	exporter.Update("device", "gpu-1", []PrometheusSample{
+		{Name: "nvidiadocker_gpu_temperature_celsius", Help: "GPU temperature.", Labels: GPULabels(1, "GPU-535c289c"), Value: 48},
+		{Name: "nvidiadocker_gpu_temperature_celsius", Help: "GPU temperature.", Labels: GPULabels(0, "GPU-66a2874a"), Value: 51.5},
+	})
+	// A later fetch replaces the samples of the metricset.
+	exporter.Update("device", "gpu-1", []PrometheusSample{
+		{Name: "nvidiadocker_gpu_temperature_celsius", Help: "GPU temperature.", Labels: GPULabels(0, "GPU-66a2874a"), Value: 52},
+	})
+
+	recorder := httptest.NewRecorder()
+	exporter.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	expected := `# HELP nvidiadocker_container_gpu_utilization_percent Utilization of a GPU assigned to the container.
+# TYPE nvidiadocker_container_gpu_utilization_percent gauge
+nvidiadocker_container_gpu_utilization_percent{host="gpu-1",container_id="id1",container_name="name1",label_com_example_team="ml \"research\"",gpu_index="0",gpu_uuid="GPU-66a2874a-837d-cd53-ab26-0d2d842d9822"} 45
+# HELP nvidiadocker_gpu_temperature_celsius GPU temperature.
+# TYPE nvidiadocker_gpu_temperature_celsius gauge
+nvidiadocker_gpu_temperature_celsius{host="gpu-1",gpu_index="0",gpu_uuid="GPU-66a2874a"} 52
+`
+	if body := recorder.Body.String(); body != expected {
+		t.Fatalf("expected\n%s\ngot\n%s", expected, body)
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != prometheusContentType {
+		t.Fatalf("unexpected content type %s", contentType)
+	}
+}
+
+func TestNewPrometheusExporter(t *testing.T) {
+	if exporter, err := NewPrometheusExporter(DefaultConfig()); exporter != nil || err != nil {
+		t.Fatalf("expected no exporter without a listen address, got %v, %v", exporter, err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.PrometheusListen = "127.0.0.1:0"
+	first, err := NewPrometheusExporter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewPrometheusExporter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Fatal("expected the metricsets to share the exporter")
+	}
+
+	// A nil exporter discards the samples.
+	var exporter *PrometheusExporter
+	exporter.Update("status", "gpu-1", []PrometheusSample{{Name: "nvidiadocker_container_gpus"}})
+}
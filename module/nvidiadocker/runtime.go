@@ -0,0 +1,120 @@
+package nvidiadocker
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	docker "github.com/fpgeek/go-dockerclient"
+)
+
+const (
+	dockerRuntimeName = "docker"
+	criRuntimeName    = "cri"
+)
+
+// Container is a running container as reported by the container runtime.
+type Container struct {
+	ID             string
+	Name           string
+	Created        time.Time
+	Labels         map[string]string
+	Image          string
+	Env            []string
+	DeviceRequests []DeviceRequest
+	// DevicePaths are the paths of the device nodes mapped into the container.
+	DevicePaths []string
+}
+
+// DeviceRequest is a request for devices of a container, e.g. `docker run --gpus`.
+type DeviceRequest struct {
+	Driver       string
+	Count        int
+	DeviceIDs    []string
+	Capabilities [][]string
+}
+
+// Runtime discovers the running containers of a container runtime. If not
+// all containers are inspected, because of the fetch deadline or because their
+// inspection failed, Containers returns the inspected containers together with
+// an *InspectError. ExcludedContainerIDs returns the IDs of the running
+// containers left out by the include and exclude rules as of the last call to
+// Containers.
+type Runtime interface {
+	Containers() ([]*Container, error)
+	ExcludedContainerIDs() []string
+}
+
+// NewRuntime returns the container runtime selected by the configuration. It
+// only returns the containers matching the include and exclude rules.
+func NewRuntime(cfg Config) (Runtime, error) {
+	filter, err := NewContainerFilter(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.Runtime {
+	case dockerRuntimeName:
+		client, err := NewDockerClient(cfg)
+		if err != nil {
+			return nil, err
+		}
+		cache := NewContainerCache(dockerClient{client}, filter, cfg.InspectWorkers, cfg.fetchTimeout(), containerCacheIdlePeriods*cfg.Period)
+		return &dockerRuntime{cache: cache}, nil
+	case criRuntimeName:
+		return newCRIRuntime(cfg, filter)
+	default:
+		return nil, fmt.Errorf("unknown runtime '%s', must be '%s' or '%s'", cfg.Runtime, dockerRuntimeName, criRuntimeName)
+	}
+}
+
+// dockerRuntime lists the containers of dockerd from the event-driven cache.
+type dockerRuntime struct {
+	cache *ContainerCache
+}
+
+func (r *dockerRuntime) Containers() ([]*Container, error) {
+	dockerContainers, err := r.cache.Containers()
+	if _, partial := err.(*InspectError); err != nil && !partial {
+		return nil, err
+	}
+
+	containers := make([]*Container, 0, len(dockerContainers))
+	for _, dockerContainer := range dockerContainers {
+		containers = append(containers, fromDockerContainer(dockerContainer))
+	}
+	return containers, err
+}
+
+func (r *dockerRuntime) ExcludedContainerIDs() []string {
+	return r.cache.ExcludedIDs()
+}
+
+func fromDockerContainer(dockerContainer *docker.Container) *Container {
+	container := &Container{
+		ID:      dockerContainer.ID,
+		Name:    strings.TrimPrefix(dockerContainer.Name, "/"),
+		Created: dockerContainer.Created,
+	}
+
+	if dockerContainer.Config != nil {
+		container.Labels = dockerContainer.Config.Labels
+		container.Image = dockerContainer.Config.Image
+		container.Env = dockerContainer.Config.Env
+	}
+
+	if dockerContainer.HostConfig != nil {
+		for _, deviceRequest := range dockerContainer.HostConfig.DeviceRequests {
+			container.DeviceRequests = append(container.DeviceRequests, DeviceRequest{
+				Driver:       deviceRequest.Driver,
+				Count:        deviceRequest.Count,
+				DeviceIDs:    deviceRequest.DeviceIDs,
+				Capabilities: deviceRequest.Capabilities,
+			})
+		}
+		for _, device := range dockerContainer.HostConfig.Devices {
+			container.DevicePaths = append(container.DevicePaths, device.PathOnHost)
+		}
+	}
+	return container
+}
@@ -0,0 +1,43 @@
+package nvidiadocker
+
+import (
+	"reflect"
+	"testing"
+
+	docker "github.com/fpgeek/go-dockerclient"
+)
+
+func TestFromDockerContainer(t *testing.T) {
+	container := fromDockerContainer(&docker.Container{
+		ID:   "4e3bb646c7ff",
+		Name: "/trainer",
+		Config: &docker.Config{
+			Env:    []string{"NVIDIA_VISIBLE_DEVICES=0"},
+			Labels: map[string]string{"maintainer": "NVIDIA CORPORATION <cudatools@nvidia.com>"},
+		},
+		HostConfig: &docker.HostConfig{
+			DeviceRequests: []docker.DeviceRequest{
+				{Count: 2, Capabilities: [][]string{{"gpu"}}},
+			},
+			Devices: []docker.Device{
+				{PathOnHost: "/dev/nvidia1", PathInContainer: "/dev/nvidia0"},
+			},
+		},
+	})
+
+	expected := &Container{
+		ID:             "4e3bb646c7ff",
+		Name:           "trainer",
+		Labels:         map[string]string{"maintainer": "NVIDIA CORPORATION <cudatools@nvidia.com>"},
+		Env:            []string{"NVIDIA_VISIBLE_DEVICES=0"},
+		DeviceRequests: []DeviceRequest{{Count: 2, Capabilities: [][]string{{"gpu"}}}},
+		DevicePaths:    []string{"/dev/nvidia1"},
+	}
+	if !reflect.DeepEqual(container, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, container)
+	}
+
+	if container := fromDockerContainer(&docker.Container{ID: "ca766152aa55"}); container.ID != "ca766152aa55" {
+		t.Fatalf("unexpected container %+v", container)
+	}
+}
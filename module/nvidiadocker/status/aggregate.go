@@ -0,0 +1,59 @@
+package status
+
+import (
+	"fmt"
+	"math"
+)
+
+// Aggregations of a device property over the GPUs assigned to a container.
+const (
+	aggregateAvg = "avg"
+	aggregateMax = "max"
+	aggregateMin = "min"
+	aggregateSum = "sum"
+)
+
+var (
+	// defaultAggregates are reported if the aggregates are not configured.
+	defaultAggregates = []string{aggregateAvg, aggregateMax}
+
+	aggregateFuncs = map[string]func(values []float64) float64{
+		aggregateAvg: func(values []float64) float64 {
+			return sum(values) / float64(len(values))
+		},
+		aggregateMax: func(values []float64) float64 {
+			max := values[0]
+			for _, value := range values[1:] {
+				max = math.Max(max, value)
+			}
+			return max
+		},
+		aggregateMin: func(values []float64) float64 {
+			min := values[0]
+			for _, value := range values[1:] {
+				min = math.Min(min, value)
+			}
+			return min
+		},
+		aggregateSum: sum,
+	}
+)
+
+func sum(values []float64) float64 {
+	var total float64
+	for _, value := range values {
+		total += value
+	}
+	return total
+}
+
+// validateAggregates returns an error for an unknown aggregation.
+func validateAggregates(aggregates []string) error {
+	for _, aggregate := range aggregates {
+		if _, found := aggregateFuncs[aggregate]; !found {
+			return fmt.Errorf("unknown aggregate '%s', must be '%s', '%s', '%s' or '%s'",
+				aggregate, aggregateAvg, aggregateMax, aggregateMin, aggregateSum)
+		}
+	}
+	return nil
+}
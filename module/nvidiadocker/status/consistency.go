@@ -0,0 +1,128 @@
+package status
+
+import (
+	"sort"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/fpgeek/nvidiadockerbeat/module/nvidiadocker"
+)
+
+// Findings of the host-level consistency check.
+const (
+	// A GPU is assigned to several containers.
+	findingGPUConflict = "gpu_conflict"
+	// A GPU runs compute processes or is utilized without being assigned to
+	// any container.
+	findingUnclaimedGPU = "unclaimed_gpu"
+	// A compute process doesn't run in any known container, e.g. a job
+	// started directly on the host.
+	findingUnmanagedProcess = "unmanaged_process"
+)
+
+// checkConsistency compares the GPU assignments of the containers with each
+// other and with the compute processes running on the GPUs, and returns an
+// event per finding. The unreported containers are running but were excluded
+// or not inspected, so their GPU assignments are unknown: their processes
+// aren't unmanaged, and GPUs which may be used by them aren't unclaimed.
+func checkConsistency(procPath string, containers []*nvidiadocker.Container, unreported map[string]bool, gpuDevices []nvidiadocker.DeviceStatus, kubeletAllocations nvidiadocker.KubeletAllocations) []common.MapStr {
+	var (
+		findings    []common.MapStr
+		claims      = map[int][]*nvidiadocker.Container{}
+		containerBy = map[string]*nvidiadocker.Container{}
+	)
+
+	for _, container := range containers {
+		if nvidiadocker.IsPodSandbox(container.Labels) {
+			continue
+		}
+		containerBy[container.ID] = container
+		for _, assignment := range nvidiadocker.GetGPUAssignments(container, gpuDevices, kubeletAllocations) {
+			claims[assignment.Index] = append(claims[assignment.Index], container)
+		}
+	}
+
+	for i := range gpuDevices {
+		device := &gpuDevices[i]
+		index := nvidiadocker.DeviceIndex(i, device)
+		claimants := claims[index]
+
+		var (
+			pids              = make([]uint, 0, len(device.Processes))
+			unmanagedFindings []common.MapStr
+			resolved          bool
+			usedByUnreported  bool
+		)
+		for _, process := range device.Processes {
+			pids = append(pids, process.PID)
+
+			// Processes which exited in the meantime can't be resolved.
+			containerID, err := nvidiadocker.ContainerIDFromPID(procPath, process.PID)
+			if err != nil {
+				continue
+			}
+			resolved = true
+			if unreported[containerID] {
+				usedByUnreported = true
+				continue
+			}
+			if _, found := containerBy[containerID]; !found {
+				finding := findingEvent(findingUnmanagedProcess, index, device, []uint{process.PID})
+				finding.Put("consistency.cgroup.containerid", containerID)
+				finding.Put("consistency.memory.used.bytes", process.MemoryUsed*mebibyte)
+				unmanagedFindings = append(unmanagedFindings, finding)
+			}
+		}
+
+		switch {
+		case len(claimants) > 1:
+			finding := findingEvent(findingGPUConflict, index, device, pids)
+			addContainers(finding, claimants)
+			findings = append(findings, finding)
+		case len(claimants) == 0 && (len(device.Processes) > 0 || device.Utilization.GPU > 0):
+			// Without resolved processes, the GPU may be used by any of the
+			// unreported containers.
+			if usedByUnreported || (!resolved && len(unreported) > 0) {
+				break
+			}
+			findings = append(findings, findingEvent(findingUnclaimedGPU, index, device, pids))
+		}
+		findings = append(findings, unmanagedFindings...)
+	}
+	return findings
+}
+
+func findingEvent(finding string, index int, device *nvidiadocker.DeviceStatus, pids []uint) common.MapStr {
+	return common.MapStr{
+		"consistency": common.MapStr{
+			"type": finding,
+			"gpu": common.MapStr{
+				"index":       index,
+				"uuid":        device.UUID,
+				"utilization": device.Utilization.GPU,
+			},
+			"pids": pids,
+		},
+	}
+}
+
+// addContainers sets the IDs and names of the containers on a finding, sorted
+// by ID so the finding is stable across fetches.
+func addContainers(event common.MapStr, containers []*nvidiadocker.Container) {
+	sorted := append([]*nvidiadocker.Container(nil), containers...)
+	sort.Sort(containersByID(sorted))
+
+	containerIDs := make([]string, 0, len(sorted))
+	containerNames := make([]string, 0, len(sorted))
+	for _, container := range sorted {
+		containerIDs = append(containerIDs, container.ID)
+		containerNames = append(containerNames, container.Name)
+	}
+	event["containerid"] = containerIDs
+	event["containername"] = containerNames
+}
+
+type containersByID []*nvidiadocker.Container
+
+func (c containersByID) Len() int           { return len(c) }
+func (c containersByID) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c containersByID) Less(i, j int) bool { return c[i].ID < c[j].ID }
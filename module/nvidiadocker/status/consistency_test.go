@@ -0,0 +1,158 @@
+package status
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/fpgeek/nvidiadockerbeat/module/nvidiadocker"
+)
+
+func TestCheckConsistency(t *testing.T) {
+	procPath, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(procPath)
+
+	var (
+		trainerID = "4e3bb646c7ff48078295daccfdbc5a34d3e0a52b2e6e87ba9c1f7e3f9e8d4b21"
+		evalID    = "ca766152aa55425fb6fcb84319732915ca766152aa55425fb6fcb84319732915"
+		strayID   = "149648d87e32715ab5c3fe6df5976c7e149648d87e32715ab5c3fe6df5976c7e"
+	)
+	writeCgroup := func(pid, content string) {
+		if err := os.MkdirAll(filepath.Join(procPath, pid), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(procPath, pid, "cgroup"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeCgroup("100", "12:devices:/docker/"+trainerID+"\n")
+	writeCgroup("101", "12:devices:/docker/"+evalID+"\n")
+	writeCgroup("200", "12:devices:/user.slice\n")
+	writeCgroup("300", "12:devices:/docker/"+strayID+"\n")
+
+	gpuDevices := []nvidiadocker.DeviceStatus{
+		{
+			Index:     toUintP(0),
+			UUID:      "GPU-66a2874a-837d-cd53-ab26-0d2d842d9822",
+			Processes: []nvidiadocker.ProcessInfo{{PID: 100, MemoryUsed: 1024}, {PID: 101, MemoryUsed: 512}},
+		},
+		{
+			Index:       toUintP(1),
+			UUID:        "GPU-535c289c-6dd8-e308-b4ca-524b0fc07fa6",
+			Utilization: nvidiadocker.UtilizationInfo{GPU: 90},
+			Processes:   []nvidiadocker.ProcessInfo{{PID: 200, MemoryUsed: 256}, {PID: 300, MemoryUsed: 128}, {PID: 400, MemoryUsed: 64}},
+		},
+		{
+			Index: toUintP(2),
+			UUID:  "GPU-9d2d1f0e-3b1c-4b7a-8f5e-0c6d7e8f9a0b",
+		},
+	}
+	containers := []*nvidiadocker.Container{
+		{ID: evalID, Name: "eval", Env: []string{"NVIDIA_VISIBLE_DEVICES=0"}},
+		{ID: trainerID, Name: "trainer", Env: []string{"NVIDIA_VISIBLE_DEVICES=0"}},
+		{ID: "idle", Name: "idle", Env: []string{"NVIDIA_VISIBLE_DEVICES=2"}},
+	}
+
+	findings := checkConsistency(procPath, containers, nil, gpuDevices, nil)
+	if len(findings) != 4 {
+		t.Fatalf("expected 4 findings, got %v", findings)
+	}
+
+	conflict := common.MapStr{
+		"consistency": common.MapStr{
+			"type": "gpu_conflict",
+			"gpu": common.MapStr{
+				"index":       0,
+				"uuid":        "GPU-66a2874a-837d-cd53-ab26-0d2d842d9822",
+				"utilization": uint(0),
+			},
+			"pids": []uint{100, 101},
+		},
+		"containerid":   []string{trainerID, evalID},
+		"containername": []string{"trainer", "eval"},
+	}
+	if !reflect.DeepEqual(findings[0], conflict) {
+		t.Fatalf("expected %v, got %v", conflict, findings[0])
+	}
+
+	if finding, _ := findings[1].GetValue("consistency.type"); finding != "unclaimed_gpu" {
+		t.Fatalf("expected the busy GPU 1 to be unclaimed, got %v", findings[1])
+	}
+	if pids, _ := findings[1].GetValue("consistency.pids"); !reflect.DeepEqual(pids, []uint{200, 300, 400}) {
+		t.Fatalf("unexpected processes on the unclaimed GPU: %v", pids)
+	}
+
+	// The exited process 400 can't be resolved.
+	for i, expected := range []struct {
+		PID         uint
+		ContainerID string
+	}{{200, ""}, {300, strayID}} {
+		finding := findings[2+i]
+		if pids, _ := finding.GetValue("consistency.pids"); !reflect.DeepEqual(pids, []uint{expected.PID}) {
+			t.Fatalf("expected an unmanaged process %d, got %v", expected.PID, finding)
+		}
+		if containerID, _ := finding.GetValue("consistency.cgroup.containerid"); containerID != expected.ContainerID {
+			t.Fatalf("expected the cgroup container '%s', got %v", expected.ContainerID, finding)
+		}
+	}
+}
+
+func TestCheckConsistencySparseDevices(t *testing.T) {
+	// Only GPUs 1 and 2 are reported, e.g. with `nvidia-smi -i 1,2`.
+	gpuDevices := []nvidiadocker.DeviceStatus{
+		{Index: toUintP(1), UUID: "GPU-66a2874a", Utilization: nvidiadocker.UtilizationInfo{GPU: 90}},
+		{Index: toUintP(2), UUID: "GPU-535c289c", Utilization: nvidiadocker.UtilizationInfo{GPU: 80}},
+	}
+	containers := []*nvidiadocker.Container{
+		{ID: "trainer", Name: "trainer", Env: []string{"NVIDIA_VISIBLE_DEVICES=1"}},
+		{ID: "eval", Name: "eval", Env: []string{"NVIDIA_VISIBLE_DEVICES=2"}},
+		{ID: "notebook", Name: "notebook", Env: []string{"NVIDIA_VISIBLE_DEVICES=2"}},
+	}
+
+	findings := checkConsistency("", containers, nil, gpuDevices, nil)
+	if len(findings) != 1 {
+		t.Fatalf("expected only the conflict on GPU 2, got %v", findings)
+	}
+	gpu, _ := findings[0].GetValue("consistency.gpu")
+	if !reflect.DeepEqual(gpu, common.MapStr{"index": 2, "uuid": "GPU-535c289c", "utilization": uint(80)}) {
+		t.Fatalf("expected the conflict on GPU 2, got %v", findings[0])
+	}
+}
+
+func TestCheckConsistencyUnreported(t *testing.T) {
+	procPath, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(procPath)
+
+	excludedID := "4e3bb646c7ff48078295daccfdbc5a34d3e0a52b2e6e87ba9c1f7e3f9e8d4b21"
+	if err := os.MkdirAll(filepath.Join(procPath, "100"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(procPath, "100", "cgroup"), []byte("12:devices:/docker/"+excludedID+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	gpuDevices := []nvidiadocker.DeviceStatus{
+		{Index: toUintP(0), UUID: "GPU-66a2874a", Processes: []nvidiadocker.ProcessInfo{{PID: 100, MemoryUsed: 1024}}},
+		// Its processes can't be resolved, so it may be used by the
+		// excluded container too.
+		{Index: toUintP(1), UUID: "GPU-535c289c", Utilization: nvidiadocker.UtilizationInfo{GPU: 90}},
+	}
+	unreported := map[string]bool{excludedID: true}
+	if findings := checkConsistency(procPath, nil, unreported, gpuDevices, nil); len(findings) != 0 {
+		t.Fatalf("expected no findings for the excluded container, got %v", findings)
+	}
+
+	// Once nothing is unreported, both are findings again.
+	if findings := checkConsistency(procPath, nil, nil, gpuDevices, nil); len(findings) != 3 {
+		t.Fatalf("expected the unclaimed GPUs and the unmanaged process, got %v", findings)
+	}
+}
@@ -0,0 +1,161 @@
+package status
+
+import (
+	"sort"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/fpgeek/nvidiadockerbeat/module/nvidiadocker"
+)
+
+const (
+	idleAllocationAlert = "idle_allocation"
+
+	alertStateOpen     = "open"
+	alertStateResolved = "resolved"
+
+	// The container's GPUs are busy again.
+	idleReasonRecovered = "recovered"
+	// The container stopped or doesn't hold GPUs anymore.
+	idleReasonReleased = "released"
+)
+
+// idleMetadataKeys are the keys of a status event copied to its alerts.
+var idleMetadataKeys = append([]string{"containerid", "containername", "labels", "kubernetes", "gpuassignments"}, nvidiadocker.LabelFieldNames...)
+
+// idleTracker detects containers, or pods with perpod, which hold GPUs but
+// keep their normalized GPU utilization below a threshold for a duration. Its
+// state is kept across Fetch calls.
+type idleTracker struct {
+	threshold float64
+	duration  time.Duration
+	states    map[string]*idleState
+}
+
+type idleState struct {
+	since       time.Time
+	reported    bool
+	utilization float64
+	metadata    common.MapStr
+}
+
+func newIdleTracker(threshold float64, duration time.Duration) *idleTracker {
+	return &idleTracker{
+		threshold: threshold,
+		duration:  duration,
+		states:    map[string]*idleState{},
+	}
+}
+
+// Update updates the idle state from the status events of a fetch and returns
+// an idle_allocation alert for each container that became idle and a resolve
+// alert for each reported container that recovered or is gone. The states of
+// the uninspected containers, which are missing from the fetch although they
+// may still run, are kept until they are inspected again.
+func (t *idleTracker) Update(events []common.MapStr, uninspected map[string]bool, now time.Time) []common.MapStr {
+	var (
+		alerts = []common.MapStr{}
+		seen   = map[string]bool{}
+	)
+
+	for _, event := range events {
+		key := idleKey(event)
+		value, err := event.GetValue("utilization.gpu.normalized")
+		if key == "" || err != nil {
+			continue
+		}
+		utilization, _ := value.(float64)
+		seen[key] = true
+
+		state, found := t.states[key]
+		if utilization >= t.threshold {
+			if found && state.reported {
+				state.utilization = utilization
+				alerts = append(alerts, t.alertEvent(state, alertStateResolved, idleReasonRecovered, now))
+			}
+			delete(t.states, key)
+			continue
+		}
+
+		if !found {
+			state = &idleState{since: now}
+			t.states[key] = state
+		}
+		state.utilization = utilization
+		state.metadata = idleMetadata(event)
+		if !state.reported && now.Sub(state.since) >= t.duration {
+			state.reported = true
+			alerts = append(alerts, t.alertEvent(state, alertStateOpen, "", now))
+		}
+	}
+
+	gone := make([]string, 0, len(t.states))
+	for key := range t.states {
+		if !seen[key] && !t.states[key].uninspected(uninspected) {
+			gone = append(gone, key)
+		}
+	}
+	sort.Strings(gone)
+	for _, key := range gone {
+		if state := t.states[key]; state.reported {
+			alerts = append(alerts, t.alertEvent(state, alertStateResolved, idleReasonReleased, now))
+		}
+		delete(t.states, key)
+	}
+	return alerts
+}
+
+// uninspected returns true if a container of the state wasn't inspected.
+func (s *idleState) uninspected(uninspected map[string]bool) bool {
+	switch containerID := s.metadata["containerid"].(type) {
+	case string:
+		return uninspected[containerID]
+	case []string:
+		for _, id := range containerID {
+			if uninspected[id] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (t *idleTracker) alertEvent(state *idleState, alertState string, reason string, now time.Time) common.MapStr {
+	alert := common.MapStr{
+		"type":        idleAllocationAlert,
+		"state":       alertState,
+		"since":       common.Time(state.since),
+		"duration":    common.MapStr{"ms": int64(now.Sub(state.since) / time.Millisecond)},
+		"threshold":   t.threshold,
+		"utilization": state.utilization,
+	}
+	if reason != "" {
+		alert["reason"] = reason
+	}
+
+	event := state.metadata.Clone()
+	event["alert"] = alert
+	return event
+}
+
+// idleKey identifies the container of a status event, or the pod with perpod.
+func idleKey(event common.MapStr) string {
+	if containerID, ok := event["containerid"].(string); ok {
+		return containerID
+	}
+	if podUID, err := event.GetValue("kubernetes.pod.uid"); err == nil {
+		podUID, _ := podUID.(string)
+		return podUID
+	}
+	return ""
+}
+
+func idleMetadata(event common.MapStr) common.MapStr {
+	metadata := common.MapStr{}
+	for _, key := range idleMetadataKeys {
+		if value, found := event[key]; found {
+			metadata[key] = value
+		}
+	}
+	return metadata
+}
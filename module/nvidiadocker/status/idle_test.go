@@ -0,0 +1,119 @@
+package status
+
+import (
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+)
+
+func TestIdleTracker(t *testing.T) {
+	tracker := newIdleTracker(5, time.Hour)
+	start := time.Date(2017, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	statusEvent := func(containerID string, utilization float64) common.MapStr {
+		return common.MapStr{
+			"containerid":   containerID,
+			"containername": "name-" + containerID,
+			"labels":        map[string]string{"team": "ml"},
+			"utilization":   common.MapStr{"gpu": common.MapStr{"normalized": utilization}},
+		}
+	}
+
+	// A container without GPUs is never idle.
+	noGPUs := common.MapStr{"containerid": "id3"}
+
+	steps := []struct {
+		At     time.Duration
+		Events []common.MapStr
+		Alerts []string
+	}{
+		{0, []common.MapStr{statusEvent("id1", 1), statusEvent("id2", 2), noGPUs}, nil},
+		{30 * time.Minute, []common.MapStr{statusEvent("id1", 4), statusEvent("id2", 80), noGPUs}, nil},
+		{time.Hour, []common.MapStr{statusEvent("id1", 0), statusEvent("id2", 0), noGPUs}, []string{"id1 open"}},
+		{90 * time.Minute, []common.MapStr{statusEvent("id1", 0), statusEvent("id2", 0)}, nil},
+		{2 * time.Hour, []common.MapStr{statusEvent("id1", 50), statusEvent("id2", 0)}, []string{"id1 resolved recovered", "id2 open"}},
+		{3 * time.Hour, []common.MapStr{statusEvent("id2", 0)}, nil},
+		{4 * time.Hour, nil, []string{"id2 resolved released"}},
+	}
+
+	for _, step := range steps {
+		alerts := tracker.Update(step.Events, nil, start.Add(step.At))
+		if len(alerts) != len(step.Alerts) {
+			t.Fatalf("at %v: expected alerts %v, got %v", step.At, step.Alerts, alerts)
+		}
+		for i, alert := range alerts {
+			description := alert["containerid"].(string) + " " + alert["alert"].(common.MapStr)["state"].(string)
+			if reason, found := alert["alert"].(common.MapStr)["reason"]; found {
+				description += " " + reason.(string)
+			}
+			if description != step.Alerts[i] {
+				t.Fatalf("at %v: expected alert %s, got %v", step.At, step.Alerts[i], alert)
+			}
+			if _, found := alert["labels"]; !found {
+				t.Fatalf("at %v: expected the container labels in %v", step.At, alert)
+			}
+		}
+	}
+}
+
+func TestIdleTrackerAlert(t *testing.T) {
+	tracker := newIdleTracker(5, 10*time.Minute)
+	start := time.Date(2017, 7, 1, 12, 0, 0, 0, time.UTC)
+	pod := common.MapStr{
+		"containerid": []string{"id1", "id2"},
+		"kubernetes":  common.MapStr{"pod": common.MapStr{"uid": "535c289c"}},
+		"utilization": common.MapStr{"gpu": common.MapStr{"normalized": 2.5}},
+	}
+
+	tracker.Update([]common.MapStr{pod}, nil, start)
+	alerts := tracker.Update([]common.MapStr{pod}, nil, start.Add(15*time.Minute))
+	if len(alerts) != 1 {
+		t.Fatalf("expected an alert for the idle pod, got %v", alerts)
+	}
+
+	expected := common.MapStr{
+		"type":        "idle_allocation",
+		"state":       "open",
+		"since":       common.Time(start),
+		"duration":    common.MapStr{"ms": int64(15 * 60 * 1000)},
+		"threshold":   float64(5),
+		"utilization": 2.5,
+	}
+	if alert := alerts[0]["alert"].(common.MapStr); alert.String() != expected.String() {
+		t.Fatalf("expected %v, got %v", expected, alert)
+	}
+	if _, found := alerts[0]["utilization"]; found {
+		t.Fatalf("alerts must only carry the container metadata, got %v", alerts[0])
+	}
+}
+
+func TestIdleTrackerUninspected(t *testing.T) {
+	tracker := newIdleTracker(5, 10*time.Minute)
+	start := time.Date(2017, 7, 1, 12, 0, 0, 0, time.UTC)
+	idle := func(containerID string) common.MapStr {
+		return common.MapStr{
+			"containerid": containerID,
+			"utilization": common.MapStr{"gpu": common.MapStr{"normalized": 1.0}},
+		}
+	}
+
+	tracker.Update([]common.MapStr{idle("id1"), idle("id2")}, nil, start)
+	if alerts := tracker.Update([]common.MapStr{idle("id1"), idle("id2")}, nil, start.Add(15*time.Minute)); len(alerts) != 2 {
+		t.Fatalf("expected both containers to be idle, got %v", alerts)
+	}
+
+	// id1 wasn't inspected, so it isn't released, while the inspected id2 is
+	// still updated and recovers.
+	busy := idle("id2")
+	busy["utilization"] = common.MapStr{"gpu": common.MapStr{"normalized": 80.0}}
+	alerts := tracker.Update([]common.MapStr{busy}, map[string]bool{"id1": true}, start.Add(20*time.Minute))
+	if len(alerts) != 1 || alerts[0]["containerid"] != "id2" || alerts[0]["alert"].(common.MapStr)["reason"] != "recovered" {
+		t.Fatalf("expected only id2 to recover, got %v", alerts)
+	}
+
+	alerts = tracker.Update(nil, nil, start.Add(25*time.Minute))
+	if len(alerts) != 1 || alerts[0]["containerid"] != "id1" || alerts[0]["alert"].(common.MapStr)["reason"] != "released" {
+		t.Fatalf("expected id1 to be released once it is inspected, got %v", alerts)
+	}
+}
@@ -0,0 +1,97 @@
+package status
+
+import (
+	"strings"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/fpgeek/nvidiadockerbeat/module/nvidiadocker"
+)
+
+type prometheusMetric struct {
+	key  string
+	name string
+	help string
+}
+
+var (
+	// prometheusContainerMetrics are exported per container.
+	prometheusContainerMetrics = []prometheusMetric{
+		{"utilization.gpu.normalized", "nvidiadocker_container_gpu_utilization_normalized_percent", "Utilization of the GPUs assigned to the container in the range of 0 to 100."},
+		{"utilization.memory.normalized", "nvidiadocker_container_gpu_memory_utilization_normalized_percent", "Used share of the memory of the GPUs assigned to the container in the range of 0 to 100."},
+	}
+	// prometheusContainerDeviceMetrics are exported per GPU assigned to a
+	// container.
+	prometheusContainerDeviceMetrics = []prometheusMetric{
+		{"utilization.gpu", "nvidiadocker_container_gpu_utilization_percent", "Utilization of a GPU assigned to the container."},
+		{"utilization.memory", "nvidiadocker_container_gpu_memory_utilization_percent", "Used share of the memory of a GPU assigned to the container."},
+	}
+	// prometheusContainerProcessMetrics are exported per GPU the processes of
+	// a container run on.
+	prometheusContainerProcessMetrics = []prometheusMetric{
+		{"used.bytes", "nvidiadocker_container_gpu_memory_used_bytes", "GPU memory used by the processes of the container on a GPU."},
+	}
+)
+
+// prometheusSamples returns the Prometheus samples of the status events of the
+// containers, skipping alerts and findings.
+func (m *MetricSet) prometheusSamples(events []common.MapStr) []nvidiadocker.PrometheusSample {
+	var samples []nvidiadocker.PrometheusSample
+	for _, event := range events {
+		devices, ok := event["devices"].([]common.MapStr)
+		if !ok {
+			continue
+		}
+
+		labels, _ := event["labels"].(map[string]string)
+		containerLabels := m.exporter.ContainerLabels(joinedString(event["containerid"]), joinedString(event["containername"]), labels)
+
+		samples = append(samples, nvidiadocker.PrometheusSample{
+			Name:   "nvidiadocker_container_gpus",
+			Help:   "Number of GPUs assigned to the container.",
+			Labels: containerLabels,
+			Value:  float64(len(devices)),
+		})
+		samples = appendSamples(samples, event, prometheusContainerMetrics, containerLabels)
+
+		for _, device := range devices {
+			samples = appendSamples(samples, device, prometheusContainerDeviceMetrics, deviceLabels(containerLabels, device))
+		}
+
+		processDevices, _ := event.GetValue("gpumemory.devices")
+		processDeviceEvents, _ := processDevices.([]common.MapStr)
+		for _, device := range processDeviceEvents {
+			samples = appendSamples(samples, device, prometheusContainerProcessMetrics, deviceLabels(containerLabels, device))
+		}
+	}
+	return samples
+}
+
+func appendSamples(samples []nvidiadocker.PrometheusSample, event common.MapStr, metrics []prometheusMetric, labels []nvidiadocker.PrometheusLabel) []nvidiadocker.PrometheusSample {
+	for _, metric := range metrics {
+		if sample, ok := nvidiadocker.EventSample(event, metric.key, metric.name, metric.help, labels); ok {
+			samples = append(samples, sample)
+		}
+	}
+	return samples
+}
+
+// deviceLabels returns the labels of the container together with the labels
+// of a GPU entry of its event.
+func deviceLabels(containerLabels []nvidiadocker.PrometheusLabel, device common.MapStr) []nvidiadocker.PrometheusLabel {
+	uuid, _ := device["uuid"].(string)
+	labels := make([]nvidiadocker.PrometheusLabel, 0, len(containerLabels)+2)
+	labels = append(labels, containerLabels...)
+	return append(labels, nvidiadocker.GPULabels(device["index"], uuid)...)
+}
+
+// joinedString returns the container ID or name of a container event, or the
+// comma separated IDs or names of a pod event.
+func joinedString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []string:
+		return strings.Join(v, ",")
+	}
+	return ""
+}
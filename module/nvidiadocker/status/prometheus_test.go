@@ -0,0 +1,58 @@
+package status
+
+import (
+	"testing"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/fpgeek/nvidiadockerbeat/module/nvidiadocker"
+)
+
+func TestPrometheusSamples(t *testing.T) {
+	gpuDevices := []nvidiadocker.DeviceStatus{
+		{Index: toUintP(0), UUID: "GPU-66a2874a", Utilization: nvidiadocker.UtilizationInfo{GPU: 10}},
+		{Index: toUintP(1), UUID: "GPU-535c289c", Utilization: nvidiadocker.UtilizationInfo{GPU: 30}},
+	}
+	m := &MetricSet{aggregates: defaultAggregates}
+	events := []common.MapStr{
+		m.fetchFromContainer(&nvidiadocker.Container{
+			ID:     "id1",
+			Name:   "name1",
+			Env:    []string{"NVIDIA_VISIBLE_DEVICES=0,1"},
+			Labels: map[string]string{"team": "ml"},
+		}, gpuDevices, nil, []nvidiadocker.ContainerProcess{
+			{Device: &gpuDevices[1], Process: nvidiadocker.ProcessInfo{PID: 100, MemoryUsed: 1024}},
+		}),
+		{"containerid": []string{"id1", "id2"}, "alert": common.MapStr{"type": "idle_allocation"}},
+	}
+
+	samples := m.prometheusSamples(events)
+	values := map[string]float64{}
+	for _, sample := range samples {
+		key := sample.Name
+		for _, label := range sample.Labels {
+			if label.Name == "gpu_index" {
+				key += "/" + label.Value
+			}
+		}
+		values[key] = sample.Value
+	}
+
+	expected := map[string]float64{
+		"nvidiadocker_container_gpus":                                      2,
+		"nvidiadocker_container_gpu_utilization_normalized_percent":        20,
+		"nvidiadocker_container_gpu_memory_utilization_normalized_percent": 0,
+		"nvidiadocker_container_gpu_utilization_percent/0":                 10,
+		"nvidiadocker_container_gpu_utilization_percent/1":                 30,
+		"nvidiadocker_container_gpu_memory_utilization_percent/0":          0,
+		"nvidiadocker_container_gpu_memory_utilization_percent/1":          0,
+		"nvidiadocker_container_gpu_memory_used_bytes/1":                   1024 * mebibyte,
+	}
+	if len(values) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, values)
+	}
+	for key, value := range expected {
+		if values[key] != value {
+			t.Fatalf("expected %s to be %v, got %v", key, value, values[key])
+		}
+	}
+}
@@ -1,26 +1,13 @@
 package status
 
 import (
-	"context"
-	"fmt"
-	"os/exec"
-	"regexp"
-	"strconv"
-	"strings"
+	"math"
 	"time"
 
 	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
 	"github.com/elastic/beats/metricbeat/mb"
-	docker "github.com/fpgeek/go-dockerclient"
-)
-
-const (
-	nvidiaRuntimeName          = "nvidia"
-	nvidiaVisibleDevicesENVKey = "NVIDIA_VISIBLE_DEVICES"
-)
-
-var (
-	nvidiaDeviceRegexp = regexp.MustCompile("^/dev/nvidia([0-9]+)$")
+	"github.com/fpgeek/nvidiadockerbeat/module/nvidiadocker"
 )
 
 // init registers the MetricSet with the central registry.
@@ -31,6 +18,10 @@ func init() {
 	}
 }
 
+const (
+	mebibyte = 1024 * 1024
+)
+
 type (
 	// MetricSet type defines all fields of the MetricSet
 	// As a minimum it must inherit the mb.BaseMetricSet fields, but can be extended with
@@ -38,58 +29,94 @@ type (
 	// multiple fetch calls.
 	MetricSet struct {
 		mb.BaseMetricSet
-		dockerClient *docker.Client
+		containers    nvidiadocker.Runtime
+		deviceBackend nvidiadocker.DeviceStatusBackend
+		procPath      string
+		perPod        bool
+		gpuOnly       bool
+		kubeletPath   string
+		aggregates    []string
+		labels        *nvidiadocker.LabelProcessor
+		idle          *idleTracker
+		exporter      *nvidiadocker.PrometheusExporter
+		hostName      string
 	}
 
 	ContainerStatus struct {
-		devices []*DeviceStatus
+		devices []*nvidiadocker.DeviceStatus
 	}
 
-	config struct {
-		DockerEndpoint string `config:"dockerendpoint"`
+	deviceMemoryUsage struct {
+		uuid      string
+		usedBytes uint64
+		pids      []uint
 	}
 )
 
-func (c *ContainerStatus) AddDevice(device *DeviceStatus) {
+func (c *ContainerStatus) AddDevice(device *nvidiadocker.DeviceStatus) {
 	c.devices = append(c.devices, device)
 }
 
 func (c *ContainerStatus) GPUSum() uint {
-	return c.PropSum(func(device *DeviceStatus) uint {
+	return c.PropSum(func(device *nvidiadocker.DeviceStatus) uint {
 		return device.Utilization.GPU
 	})
 }
 
 func (c *ContainerStatus) GPUMemorySum() uint {
-	return c.PropSum(func(device *DeviceStatus) uint {
+	return c.PropSum(func(device *nvidiadocker.DeviceStatus) uint {
 		return device.Utilization.Memory
 	})
 }
 
 func (c *ContainerStatus) TemperatureAverage() float64 {
-	return c.PropAverage(func(device *DeviceStatus) uint {
+	return c.PropAverage(func(device *nvidiadocker.DeviceStatus) uint {
 		return device.Temperature
 	})
 }
 
-func (c *ContainerStatus) PropSum(getPropFunc func(device *DeviceStatus) uint) uint {
-	var total uint
-	for _, device := range c.devices {
-		total += getPropFunc(device)
-	}
-	return total
+func (c *ContainerStatus) PropSum(getPropFunc func(device *nvidiadocker.DeviceStatus) uint) uint {
+	return uint(c.PropAggregate(aggregateSum, uintProp(getPropFunc)))
 }
 
-func (c *ContainerStatus) PropAverage(getPropFunc func(device *DeviceStatus) uint) float64 {
-	if len(c.devices) == 0 {
+func (c *ContainerStatus) PropAverage(getPropFunc func(device *nvidiadocker.DeviceStatus) uint) float64 {
+	return c.PropAggregate(aggregateAvg, uintProp(getPropFunc))
+}
+
+// PropAggregate aggregates a property over the devices of the container with
+// one of avg, max, min or sum. It returns 0 for a container without devices.
+func (c *ContainerStatus) PropAggregate(aggregate string, getPropFunc func(device *nvidiadocker.DeviceStatus) float64) float64 {
+	aggregateFunc, found := aggregateFuncs[aggregate]
+	if !found || len(c.devices) == 0 {
 		return 0
 	}
 
-	var total uint
+	values := make([]float64, 0, len(c.devices))
 	for _, device := range c.devices {
-		total += getPropFunc(device)
+		values = append(values, getPropFunc(device))
+	}
+	return aggregateFunc(values)
+}
+
+// PropAggregates returns the given aggregates of a property by their names.
+func (c *ContainerStatus) PropAggregates(aggregates []string, getPropFunc func(device *nvidiadocker.DeviceStatus) float64) common.MapStr {
+	event := common.MapStr{}
+	for _, aggregate := range aggregates {
+		event[aggregate] = c.PropAggregate(aggregate, getPropFunc)
+	}
+	return event
+}
+
+// NormalizedUtilization returns the utilization of the container's devices
+// as a share of their total capacity, in the range of 0 to 100.
+func (c *ContainerStatus) NormalizedUtilization(getPropFunc func(device *nvidiadocker.DeviceStatus) uint) float64 {
+	return math.Min(math.Max(c.PropAverage(getPropFunc), 0), 100)
+}
+
+func uintProp(getPropFunc func(device *nvidiadocker.DeviceStatus) uint) func(device *nvidiadocker.DeviceStatus) float64 {
+	return func(device *nvidiadocker.DeviceStatus) float64 {
+		return float64(getPropFunc(device))
 	}
-	return float64(total) / float64(len(c.devices))
 }
 
 // New create a new instance of the MetricSet
@@ -97,205 +124,550 @@ func (c *ContainerStatus) PropAverage(getPropFunc func(device *DeviceStatus) uin
 // configuration entries if needed.
 func New(base mb.BaseMetricSet) (mb.MetricSet, error) {
 
-	cfg := config{
-		DockerEndpoint: "",
-	}
+	cfg := nvidiadocker.DefaultConfig()
 
 	if err := base.Module().UnpackConfig(&cfg); err != nil {
 		return nil, err
 	}
+	cfg, err := nvidiadocker.HostConfig(cfg, base.Host())
+	if err != nil {
+		return nil, err
+	}
 
-	dockerClient, err := docker.NewClient(cfg.DockerEndpoint)
+	aggregates := cfg.Aggregates
+	if len(aggregates) == 0 {
+		aggregates = defaultAggregates
+	}
+	if err := validateAggregates(aggregates); err != nil {
+		return nil, err
+	}
+
+	runtime, err := nvidiadocker.NewRuntime(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	return &MetricSet{
+	deviceBackend, err := nvidiadocker.NewDeviceStatusBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	labels, err := nvidiadocker.NewLabelProcessor(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	exporter, err := nvidiadocker.NewPrometheusExporter(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &MetricSet{
 		BaseMetricSet: base,
-		dockerClient:  dockerClient,
-	}, nil
+		containers:    runtime,
+		deviceBackend: deviceBackend,
+		procPath:      cfg.ProcPath,
+		perPod:        cfg.PerPod,
+		gpuOnly:       cfg.GPUOnly,
+		kubeletPath:   cfg.KubeletCheckpoint,
+		aggregates:    aggregates,
+		labels:        labels,
+		exporter:      exporter,
+		hostName:      nvidiadocker.HostName(base.Host()),
+	}
+	// Idle allocations are only detected if a duration is configured.
+	if cfg.IdleDuration > 0 {
+		m.idle = newIdleTracker(cfg.IdleThreshold, cfg.IdleDuration)
+	}
+	return m, nil
+}
+
+// Close releases the GPU status backend. The metricbeat this beat is built on
+// never closes its metricsets, so Close is only used by the tests.
+func (m *MetricSet) Close() error {
+	return nvidiadocker.CloseDeviceStatusBackend(m.deviceBackend)
 }
 
 // Fetch methods implements the data gathering and data conversion to the right format
 // It returns the event which is then forward to the output. In case of an error, a
 // descriptive error must be returned.
+// Containers which couldn't be inspected are reported with an error event each,
+// and every fetch ends with an event summarising what it skipped.
 func (m *MetricSet) Fetch() ([]common.MapStr, error) {
-	apiContainers, err := m.dockerClient.ListContainers(docker.ListContainersOptions{})
+	containers, err := m.containers.Containers()
+	inspectErr, partial := err.(*nvidiadocker.InspectError)
+	if partial {
+		logp.Warn("nvidiadocker: reporting the containers which were inspected: %v", err)
+	} else if err != nil {
+		return nil, err
+	}
+
+	// The GPUs are checked even without containers, as they may still be
+	// used by processes on the host.
+	gpuDevices, err := m.deviceBackend.DeviceStatuses()
 	if err != nil {
 		return nil, err
 	}
 
-	if len(apiContainers) == 0 {
-		return []common.MapStr{}, nil
+	kubeletAllocations, err := nvidiadocker.ReadKubeletCheckpoint(m.kubeletPath)
+	if err != nil {
+		logp.Warn("nvidiadocker: failed to read the kubelet checkpoint %s: %v", m.kubeletPath, err)
 	}
 
-	output, err := execNvidiaSMICommand()
+	events, err := m.fetchFromContainers(containers, gpuDevices, kubeletAllocations)
 	if err != nil {
 		return nil, err
 	}
+	if m.exporter != nil {
+		m.exporter.Update("status", m.hostName, m.prometheusSamples(events))
+	}
+	m.processLabels(events)
+
+	allEvents := append(events, checkConsistency(m.procPath, containers, m.unreportedContainers(inspectErr), gpuDevices, kubeletAllocations)...)
+	if partial {
+		allEvents = append(allEvents, errorEvents(inspectErr)...)
+	}
+	allEvents = append(allEvents, m.idleAlerts(events, uninspectedContainers(inspectErr))...)
+	allEvents = append(allEvents, fetchEvent(len(events), inspectErr, gpuDevices))
+	return nvidiadocker.TagHost(allEvents, m.hostName), nil
+}
 
-	gpuDevices, err := getGPUDeviceStatus(output)
+// unreportedContainers returns the IDs of the running containers which are
+// missing from the fetch because they are excluded or weren't inspected.
+func (m *MetricSet) unreportedContainers(err *nvidiadocker.InspectError) map[string]bool {
+	unreported := map[string]bool{}
+	for _, id := range m.containers.ExcludedContainerIDs() {
+		unreported[id] = true
+	}
+	for id := range uninspectedContainers(err) {
+		unreported[id] = true
+	}
+	return unreported
+}
+
+// uninspectedContainers returns the IDs of the running containers which
+// timed out or failed to be inspected.
+func uninspectedContainers(err *nvidiadocker.InspectError) map[string]bool {
+	uninspected := map[string]bool{}
 	if err != nil {
-		return nil, err
+		for _, id := range err.TimedOut {
+			uninspected[id] = true
+		}
+		for _, id := range err.FailedIDs() {
+			uninspected[id] = true
+		}
 	}
+	return uninspected
+}
 
-	return m.fetchFromContainers(apiContainers, gpuDevices)
+// errorEvents returns an event with the reason for each container which
+// couldn't be inspected and is missing from the fetch.
+func errorEvents(err *nvidiadocker.InspectError) []common.MapStr {
+	events := make([]common.MapStr, 0, err.Skipped())
+	for _, id := range err.TimedOut {
+		events = append(events, common.MapStr{
+			"containerid": id,
+			"error": common.MapStr{
+				"message": "not inspected before the fetch deadline",
+			},
+		})
+	}
+	for _, containerErr := range err.Failed {
+		events = append(events, common.MapStr{
+			"containerid":   containerErr.ID,
+			"containername": containerErr.Name,
+			"error": common.MapStr{
+				"message": containerErr.Err.Error(),
+			},
+		})
+	}
+	return events
 }
 
-func (m *MetricSet) fetchFromContainers(apiContainers []docker.APIContainers, gpuDevices []DeviceStatus) ([]common.MapStr, error) {
-	allEvents := make([]common.MapStr, 0, len(apiContainers))
-	for _, apiContainer := range apiContainers {
-		if container, err := m.dockerClient.InspectContainer(apiContainer.ID); err == nil {
-			event := fetchFromContainer(container, gpuDevices)
-			allEvents = append(allEvents, event)
+// fetchEvent returns the summary of a fetch, with the number of reported
+// containers or pods and the containers and GPU fields which were skipped, so
+// gaps in the reported data can be explained.
+func fetchEvent(reported int, err *nvidiadocker.InspectError, gpuDevices []nvidiadocker.DeviceStatus) common.MapStr {
+	var (
+		timedOut = []string{}
+		failed   = []string{}
+	)
+	if err != nil {
+		timedOut = append(timedOut, err.TimedOut...)
+		failed = err.FailedIDs()
+	}
+
+	var (
+		invalidCount  int
+		invalidFields = []string{}
+	)
+	for _, device := range gpuDevices {
+		invalidCount += len(device.InvalidFields)
+		for _, field := range device.InvalidFields {
+			if !containsString(invalidFields, field) {
+				invalidFields = append(invalidFields, field)
+			}
 		}
 	}
-	return allEvents, nil
+
+	return common.MapStr{
+		"fetch": common.MapStr{
+			"reported": common.MapStr{
+				"count": reported,
+			},
+			"skipped": common.MapStr{
+				"count": len(timedOut) + len(failed),
+			},
+			"timedout": common.MapStr{
+				"count":        len(timedOut),
+				"containerids": timedOut,
+			},
+			"failed": common.MapStr{
+				"count":        len(failed),
+				"containerids": failed,
+			},
+			"gpus": common.MapStr{
+				"count": len(gpuDevices),
+				"invalidfields": common.MapStr{
+					"count": invalidCount,
+					"names": invalidFields,
+				},
+			},
+		},
+	}
 }
 
-func getGPUDeviceStatus(nvidiaSmiRunOutput string) ([]DeviceStatus, error) {
-	lines := strings.Split(strings.TrimSpace(nvidiaSmiRunOutput), "\n")
-	deviceStatuses := make([]DeviceStatus, 0, len(lines))
-	for _, line := range lines {
-		contents := strings.Split(line, ",")
-		if len(contents) != 5 {
+// processLabels replaces the labels of the status events with the processed
+// labels and adds the fields of the promoted labels. It runs after the
+// Prometheus samples are taken, as they select the labels by their keys.
+func (m *MetricSet) processLabels(events []common.MapStr) {
+	if m.labels == nil {
+		return
+	}
+
+	for _, event := range events {
+		labels, ok := event["labels"].(map[string]string)
+		if !ok {
 			continue
 		}
+		event.Update(m.labels.Fields(labels))
+		event["labels"] = m.labels.Labels(labels)
+	}
+}
 
-		index, err := strconv.ParseUint(strings.TrimSpace(contents[0]), 10, 64)
-		if err != nil {
-			return nil, err
-		}
+// idleAlerts returns the idle allocation alerts for the status events of a
+// fetch, if idle allocations are detected.
+func (m *MetricSet) idleAlerts(events []common.MapStr, uninspected map[string]bool) []common.MapStr {
+	if m.idle == nil {
+		return []common.MapStr{}
+	}
+	return m.idle.Update(events, uninspected, time.Now())
+}
 
-		gpuUtil, err := strconv.ParseUint(strings.TrimSpace(contents[1]), 10, 64)
-		if err != nil {
-			return nil, err
-		}
+func (m *MetricSet) fetchFromContainers(containers []*nvidiadocker.Container, gpuDevices []nvidiadocker.DeviceStatus, kubeletAllocations nvidiadocker.KubeletAllocations) ([]common.MapStr, error) {
+	containerProcesses := nvidiadocker.ContainerProcesses(m.procPath, gpuDevices)
+	allEvents := make([]common.MapStr, 0, len(containers))
 
-		memTotal, err := strconv.ParseFloat(strings.TrimSpace(contents[2]), 10)
-		if err != nil {
-			return nil, err
+	var (
+		podUIDs       []string
+		podContainers = map[string][]*nvidiadocker.Container{}
+	)
+	for _, container := range containers {
+		if nvidiadocker.IsPodSandbox(container.Labels) {
+			continue
 		}
 
-		memUsed, err := strconv.ParseFloat(strings.TrimSpace(contents[3]), 10)
-		if err != nil {
-			return nil, err
+		if m.perPod {
+			if pod := nvidiadocker.GetKubernetesMetadata(container.Labels); pod != nil {
+				if _, found := podContainers[pod.PodUID]; !found {
+					podUIDs = append(podUIDs, pod.PodUID)
+				}
+				podContainers[pod.PodUID] = append(podContainers[pod.PodUID], container)
+				continue
+			}
 		}
 
-		temperature, err := strconv.ParseUint(strings.TrimSpace(contents[4]), 10, 64)
-		if err != nil {
-			return nil, err
+		if m.gpuOnly && !hasGPUAssignments([]*nvidiadocker.Container{container}, gpuDevices, kubeletAllocations) {
+			continue
 		}
+		event := m.fetchFromContainer(container, gpuDevices, kubeletAllocations, containerProcesses[container.ID])
+		allEvents = append(allEvents, event)
+	}
 
-		deviceStatuses = append(deviceStatuses, DeviceStatus{
-			Index:       toUintP(uint(index)),
-			Temperature: uint(temperature),
-			Utilization: UtilizationInfo{
-				GPU:    uint(gpuUtil),
-				Memory: uint((memUsed / memTotal) * 100.0),
-			},
-		})
-
+	for _, podUID := range podUIDs {
+		if m.gpuOnly && !hasGPUAssignments(podContainers[podUID], gpuDevices, kubeletAllocations) {
+			continue
+		}
+		var processes []nvidiadocker.ContainerProcess
+		for _, container := range podContainers[podUID] {
+			processes = append(processes, containerProcesses[container.ID]...)
+		}
+		event := m.fetchFromPod(podContainers[podUID], gpuDevices, kubeletAllocations, processes)
+		allEvents = append(allEvents, event)
 	}
-	return deviceStatuses, nil
+	return allEvents, nil
 }
 
-func execNvidiaSMICommand() (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30 * time.Second)
-	defer cancel()
-
-	outputBytes, err := exec.CommandContext(ctx, "/usr/bin/nvidia-smi",
-		"--query-gpu=index,utilization.gpu,memory.total,memory.used,temperature.gpu",
-		"--format=csv,noheader,nounits",
-	).Output()
-	if err != nil {
-		return "", err
+// hasGPUAssignments returns true if a GPU is assigned to any of the
+// containers.
+func hasGPUAssignments(containers []*nvidiadocker.Container, gpuDevices []nvidiadocker.DeviceStatus, kubeletAllocations nvidiadocker.KubeletAllocations) bool {
+	for _, container := range containers {
+		if len(nvidiadocker.GetGPUAssignments(container, gpuDevices, kubeletAllocations)) > 0 {
+			return true
+		}
 	}
-	return fmt.Sprintf("%s", outputBytes), nil
+	return false
 }
 
-func fetchFromContainer(container *docker.Container, gpuDevices []DeviceStatus) common.MapStr {
+func (m *MetricSet) fetchFromContainer(container *nvidiadocker.Container, gpuDevices []nvidiadocker.DeviceStatus, kubeletAllocations nvidiadocker.KubeletAllocations, processes []nvidiadocker.ContainerProcess) common.MapStr {
 	var (
-		gpuDevicesLen   = len(gpuDevices)
 		containerID     = container.ID
-		containerName   = strings.TrimPrefix(container.Name, "/")
-		containerLabels = container.Config.Labels
+		containerName   = container.Name
+		containerLabels = container.Labels
 		event           = common.MapStr{
 			"containerid":   containerID,
 			"containername": containerName,
 			"labels":        containerLabels,
 		}
-		cStatus = &ContainerStatus{}
 	)
 
-	deviceIndices := getGPUDeviceIndices(container)
-	for _, deviceIndex := range deviceIndices {
-		if deviceIndex < gpuDevicesLen {
-			cStatus.AddDevice(&gpuDevices[deviceIndex])
-		}
+	if pod := nvidiadocker.GetKubernetesMetadata(containerLabels); pod != nil {
+		event["kubernetes"] = kubernetesEvent(pod, pod.ContainerName)
 	}
 
-	event["device"] = common.MapStr{
-		"Utilization": common.MapStr{
-			"GPU":    cStatus.GPUSum(),
-			"Memory": cStatus.GPUMemorySum(),
-		},
-		"Temperature": cStatus.TemperatureAverage(),
-	}
+	assignments := nvidiadocker.GetGPUAssignments(container, gpuDevices, kubeletAllocations)
+	m.addGPUStatus(event, assignments, gpuDevices, processes)
 	return event
 }
 
-func getGPUDeviceIndices(container *docker.Container) []int {
-	if container.HostConfig.DeviceRequests != nil {
-		for _, deviceReq := range container.HostConfig.DeviceRequests {
-			if isIncludeGPUCapability(deviceReq.Capabilities) {
-				return getNvidiaDevicesFromDeviceIDs(deviceReq.DeviceIDs)
+// fetchFromPod returns a single event for the containers of a pod, with the
+// GPU status aggregated over the GPUs assigned to any of them.
+func (m *MetricSet) fetchFromPod(containers []*nvidiadocker.Container, gpuDevices []nvidiadocker.DeviceStatus, kubeletAllocations nvidiadocker.KubeletAllocations, processes []nvidiadocker.ContainerProcess) common.MapStr {
+	var (
+		pod            = nvidiadocker.GetKubernetesMetadata(containers[0].Labels)
+		containerIDs   = make([]string, 0, len(containers))
+		containerNames = make([]string, 0, len(containers))
+		podContainers  = make([]string, 0, len(containers))
+		labels         = map[string]string{}
+		assignments    []nvidiadocker.GPUAssignment
+	)
+
+	for k, v := range containers[0].Labels {
+		labels[k] = v
+	}
+	for _, container := range containers {
+		containerIDs = append(containerIDs, container.ID)
+		containerNames = append(containerNames, container.Name)
+		podContainers = append(podContainers, nvidiadocker.GetKubernetesMetadata(container.Labels).ContainerName)
+
+		// Only the labels shared by all containers belong to the pod.
+		for k, v := range labels {
+			if container.Labels[k] != v {
+				delete(labels, k)
 			}
 		}
+
+		assignments = mergeGPUAssignments(assignments, nvidiadocker.GetGPUAssignments(container, gpuDevices, kubeletAllocations))
+	}
+
+	event := common.MapStr{
+		"containerid":   containerIDs,
+		"containername": containerNames,
+		"labels":        labels,
+		"kubernetes":    kubernetesEvent(pod, podContainers),
 	}
-	return getNvidiaDevicesFromEnvs(container.Config.Env)
+	m.addGPUStatus(event, assignments, gpuDevices, processes)
+	return event
 }
 
-func toUintP(val uint) *uint {
-	return &val
+func kubernetesEvent(pod *nvidiadocker.KubernetesMetadata, containerName interface{}) common.MapStr {
+	return common.MapStr{
+		"pod": common.MapStr{
+			"name": pod.PodName,
+			"uid":  pod.PodUID,
+		},
+		"namespace": pod.Namespace,
+		"container": common.MapStr{
+			"name": containerName,
+		},
+	}
 }
 
-func getNvidiaDevicesFromEnvs(env []string) []int {
-	deviceIndices := make([]int, 0, 8)
-	for _, envStr := range env {
-		if strings.HasPrefix(envStr, fmt.Sprintf("%s=", nvidiaVisibleDevicesENVKey)) {
-			splitEnvStrs := strings.Split(envStr, "=")
-			if len(splitEnvStrs) == 2 {
-				for _, deviceIndexStr := range strings.Split(splitEnvStrs[1], ",") {
-					if deviceIndex, err := strconv.ParseInt(deviceIndexStr, 10, 64); err == nil {
-						deviceIndices = append(deviceIndices, int(deviceIndex))
-					}
+// mergeGPUAssignments adds the assignments which are not in the list yet and
+// merges the sources of the others.
+func mergeGPUAssignments(assignments []nvidiadocker.GPUAssignment, other []nvidiadocker.GPUAssignment) []nvidiadocker.GPUAssignment {
+	for _, assignment := range other {
+		found := false
+		for i := range assignments {
+			if assignments[i].Index != assignment.Index {
+				continue
+			}
+			found = true
+			for _, source := range assignment.Sources {
+				if !containsString(assignments[i].Sources, source) {
+					assignments[i].Sources = append(assignments[i].Sources, source)
 				}
 			}
 		}
+		if !found {
+			assignments = append(assignments, nvidiadocker.GPUAssignment{
+				Index:   assignment.Index,
+				Sources: append([]string(nil), assignment.Sources...),
+			})
+		}
 	}
-	return deviceIndices
+	return assignments
 }
 
-func getNvidiaDevicesFromDeviceIDs(strDeviceIDs []string) []int {
-	deviceIndices := make([]int, 0, 8)
-	for _, strDeviceID := range strDeviceIDs {
-		if deviceIndex, err := strconv.ParseInt(strDeviceID, 10, 64); err == nil {
-			deviceIndices = append(deviceIndices, int(deviceIndex))
+func (m *MetricSet) addGPUStatus(event common.MapStr, assignments []nvidiadocker.GPUAssignment, gpuDevices []nvidiadocker.DeviceStatus, processes []nvidiadocker.ContainerProcess) {
+	var (
+		devicesByIndex = nvidiadocker.DevicesByIndex(gpuDevices)
+		cStatus        = &ContainerStatus{}
+	)
+
+	assignmentEvents := make([]common.MapStr, 0, len(assignments))
+	deviceEvents := make([]common.MapStr, 0, len(assignments))
+	for _, assignment := range assignments {
+		if device, found := devicesByIndex[assignment.Index]; found {
+			cStatus.AddDevice(device)
+			deviceEvents = append(deviceEvents, common.MapStr{
+				"index": assignment.Index,
+				"uuid":  device.UUID,
+				"utilization": common.MapStr{
+					"gpu":    device.Utilization.GPU,
+					"memory": device.Utilization.Memory,
+				},
+				"memory": common.MapStr{
+					"used": common.MapStr{
+						"bytes": device.Memory.Used,
+						"pct":   device.Memory.UsedPct,
+					},
+					"free": common.MapStr{
+						"bytes": device.Memory.Free,
+					},
+					"total": common.MapStr{
+						"bytes": device.Memory.Total,
+					},
+				},
+				"temperature": device.Temperature,
+			})
 		}
+		assignmentEvents = append(assignmentEvents, common.MapStr{
+			"index":   assignment.Index,
+			"sources": assignment.Sources,
+		})
 	}
-	return deviceIndices
+	event["gpuassignments"] = assignmentEvents
+	event["devices"] = deviceEvents
+
+	event["device"] = common.MapStr{
+		"Utilization": common.MapStr{
+			"GPU":    cStatus.GPUSum(),
+			"Memory": cStatus.GPUMemorySum(),
+		},
+		"Temperature": cStatus.TemperatureAverage(),
+	}
+
+	if len(cStatus.devices) > 0 {
+		event["utilization"] = common.MapStr{
+			"gpu": common.MapStr{
+				"normalized": cStatus.NormalizedUtilization(func(device *nvidiadocker.DeviceStatus) uint {
+					return device.Utilization.GPU
+				}),
+			},
+			"memory": common.MapStr{
+				"normalized": cStatus.NormalizedUtilization(func(device *nvidiadocker.DeviceStatus) uint {
+					return device.Utilization.Memory
+				}),
+			},
+		}
+		event["aggregate"] = common.MapStr{
+			"utilization": common.MapStr{
+				"gpu": cStatus.PropAggregates(m.aggregates, func(device *nvidiadocker.DeviceStatus) float64 {
+					return float64(device.Utilization.GPU)
+				}),
+				"memory": cStatus.PropAggregates(m.aggregates, func(device *nvidiadocker.DeviceStatus) float64 {
+					return float64(device.Utilization.Memory)
+				}),
+			},
+			"memory": common.MapStr{
+				"used": common.MapStr{
+					"bytes": cStatus.PropAggregates(m.aggregates, func(device *nvidiadocker.DeviceStatus) float64 {
+						return float64(device.Memory.Used)
+					}),
+					"pct": cStatus.PropAggregates(m.aggregates, func(device *nvidiadocker.DeviceStatus) float64 {
+						return device.Memory.UsedPct
+					}),
+				},
+				"free": common.MapStr{
+					"bytes": cStatus.PropAggregates(m.aggregates, func(device *nvidiadocker.DeviceStatus) float64 {
+						return float64(device.Memory.Free)
+					}),
+				},
+				"total": common.MapStr{
+					"bytes": cStatus.PropAggregates(m.aggregates, func(device *nvidiadocker.DeviceStatus) float64 {
+						return float64(device.Memory.Total)
+					}),
+				},
+			},
+			"temperature": cStatus.PropAggregates(m.aggregates, func(device *nvidiadocker.DeviceStatus) float64 {
+				return float64(device.Temperature)
+			}),
+		}
+	}
+	event["gpumemory"] = processMemory(processes)
 }
 
-func isIncludeGPUCapability(capabilities [][]string) bool {
-	for _, caps := range capabilities {
-		for _, capValue := range caps {
-			if capValue == "gpu" {
-				return true
-			}
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
 		}
 	}
 	return false
 }
 
+// processMemory sums up the GPU memory held by the compute processes of a
+// container, per device and in total.
+func processMemory(processes []nvidiadocker.ContainerProcess) common.MapStr {
+	var (
+		totalBytes    uint64
+		deviceIndices []uint
+		deviceUsages  = map[uint]*deviceMemoryUsage{}
+	)
+
+	for _, process := range processes {
+		usedBytes := process.Process.MemoryUsed * mebibyte
+		totalBytes += usedBytes
 
+		index := *process.Device.Index
+		usage, found := deviceUsages[index]
+		if !found {
+			usage = &deviceMemoryUsage{uuid: process.Device.UUID}
+			deviceUsages[index] = usage
+			deviceIndices = append(deviceIndices, index)
+		}
+		usage.usedBytes += usedBytes
+		usage.pids = append(usage.pids, process.Process.PID)
+	}
+
+	devices := make([]common.MapStr, 0, len(deviceIndices))
+	for _, index := range deviceIndices {
+		usage := deviceUsages[index]
+		devices = append(devices, common.MapStr{
+			"index": index,
+			"uuid":  usage.uuid,
+			"used": common.MapStr{
+				"bytes": usage.usedBytes,
+			},
+			"pids": usage.pids,
+		})
+	}
+
+	return common.MapStr{
+		"used": common.MapStr{
+			"bytes": totalBytes,
+		},
+		"devices": devices,
+	}
+}
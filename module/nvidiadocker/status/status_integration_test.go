@@ -0,0 +1,30 @@
+// +build integration
+
+package status
+
+import (
+	"testing"
+
+	mbtest "github.com/elastic/beats/metricbeat/mb/testing"
+)
+
+// TestData expects the dev mock of nvidia-docker-plugin (dev/main.go) on
+// localhost:3476 and a Docker daemon on the default socket.
+func TestData(t *testing.T) {
+	f := mbtest.NewEventsFetcher(t, getConfig())
+	err := mbtest.WriteEvents(f, t)
+	if err != nil {
+		t.Fatal("write", err)
+	}
+}
+
+func getConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"module":         "nvidiadocker",
+		"metricsets":     []string{"status"},
+		"hosts":          []string{"localhost"},
+		"apiurl":         "http://localhost:3476",
+		"gpubackend":     "plugin",
+		"dockerendpoint": "unix:///var/run/docker.sock",
+	}
+}
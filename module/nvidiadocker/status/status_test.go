@@ -5,244 +5,486 @@ import (
 	"reflect"
 	"testing"
 
-	docker "github.com/fpgeek/go-dockerclient"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/fpgeek/nvidiadockerbeat/module/nvidiadocker"
 )
 
-func TestNvidiaDeviceRegexp(t *testing.T) {
-	testDatas := []struct {
-		DeviceName  string
-		DeviceIndex string
-		Matched     bool
-	}{
-		{
-			"/dev/nvidia0",
-			"0",
-			true,
-		},
-		{
-			"/dev/nvidia12",
-			"12",
-			true,
-		},
-		{
-			"/dev/test0",
-			"",
-			false,
-		},
-		{
-			"/nvidia0",
-			"",
-			false,
-		},
-		{
-			"/dev/nvidia",
-			"",
-			false,
-		},
-	}
-
-	for _, testData := range testDatas {
-		findStrs := nvidiaDeviceRegexp.FindStringSubmatch(testData.DeviceName)
-		if (findStrs != nil) != testData.Matched {
-			t.Fatal("not matched")
-		}
-
-		if testData.Matched {
-			if !reflect.DeepEqual([]string{testData.DeviceName, testData.DeviceIndex}, findStrs) {
-				t.Fatal("not matched")
-			}
-		}
-
-	}
-}
-
 func TestFetchFromContainer(t *testing.T) {
-	gpuDevices := []DeviceStatus{
+	gpuDevices := []nvidiadocker.DeviceStatus{
 		{
 			Index:       toUintP(0),
+			MinorNumber: toUintP(0),
 			Temperature: 15,
-			Utilization: UtilizationInfo{
+			Utilization: nvidiadocker.UtilizationInfo{
 				GPU:    10,
 				Memory: 10,
 			},
+			Memory: nvidiadocker.MemoryInfo{
+				Used:    1 * gibibyte,
+				Free:    9 * gibibyte,
+				Total:   10 * gibibyte,
+				UsedPct: 0.1,
+			},
 		},
 		{
 			Index:       toUintP(1),
+			MinorNumber: toUintP(1),
 			Temperature: 14,
-			Utilization: UtilizationInfo{
+			Utilization: nvidiadocker.UtilizationInfo{
 				GPU:    12,
 				Memory: 6,
 			},
+			Memory: nvidiadocker.MemoryInfo{
+				Used:    3 * gibibyte,
+				Free:    7 * gibibyte,
+				Total:   10 * gibibyte,
+				UsedPct: 0.3,
+			},
 		},
 		{
 			Index:       toUintP(2),
+			MinorNumber: toUintP(2),
 			Temperature: 48,
-			Utilization: UtilizationInfo{
+			Utilization: nvidiadocker.UtilizationInfo{
 				GPU:    30,
 				Memory: 40,
 			},
 		},
 		{
 			Index:       toUintP(3),
+			MinorNumber: toUintP(3),
 			Temperature: 20,
-			Utilization: UtilizationInfo{
+			Utilization: nvidiadocker.UtilizationInfo{
 				GPU:    12,
 				Memory: 14,
 			},
 		},
 	}
 
-	event := fetchFromContainer(&docker.Container{
-		ID:   "id1",
-		Name: "name1",
-		HostConfig: &docker.HostConfig{
-			Devices: []docker.Device{
-				{
-					PathOnHost:      "/dev/nvidia0",
-					PathInContainer: "/dev/nvidia0",
-				},
-				{
-					PathOnHost:      "/dev/nvidia1",
-					PathInContainer: "/dev/nvidia1",
-				},
-			},
+	m := &MetricSet{aggregates: defaultAggregates}
+	event := m.fetchFromContainer(&nvidiadocker.Container{
+		ID:          "id1",
+		Name:        "name1",
+		DevicePaths: []string{"/dev/nvidia0", "/dev/nvidia1"},
+		Labels: map[string]string{
+			"com.kakaobrain.cloud.agent.id":       "4e3bb646-c7ff-4807-8295-daccfdbc5a34-S1",
+			"com.kakaobrain.cloud.framework.id":   "ca766152-aa55-425f-b6fc-b84319732915-0000",
+			"com.kakaobrain.cloud.framework.name": "__deepcloud-dev__",
+			"com.kakaobrain.cloud.server.name":    "dave.go-172.28.11.37:1028",
+			"com.nvidia.build.id":                 "20511715",
+			"com.nvidia.build.ref":                "8cbbe3f50991afed6055bb714f79783fab77af54",
+			"com.nvidia.cuda.version":             "8.0.61",
+			"com.nvidia.cudnn.version":            "5.1.10",
+			"com.nvidia.volumes.needed":           "nvidia_driver",
+			"maintainer":                          "NVIDIA CORPORATION <cudatools@nvidia.com>",
 		},
-		Config: &docker.Config{
-			Labels: map[string]string{
-				"com.kakaobrain.cloud.agent.id":       "4e3bb646-c7ff-4807-8295-daccfdbc5a34-S1",
-				"com.kakaobrain.cloud.framework.id":   "ca766152-aa55-425f-b6fc-b84319732915-0000",
-				"com.kakaobrain.cloud.framework.name": "__deepcloud-dev__",
-				"com.kakaobrain.cloud.server.name":    "dave.go-172.28.11.37:1028",
-				"com.nvidia.build.id":                 "20511715",
-				"com.nvidia.build.ref":                "8cbbe3f50991afed6055bb714f79783fab77af54",
-				"com.nvidia.cuda.version":             "8.0.61",
-				"com.nvidia.cudnn.version":            "5.1.10",
-				"com.nvidia.volumes.needed":           "nvidia_driver",
-				"maintainer":                          "NVIDIA CORPORATION <cudatools@nvidia.com>",
-			},
-		},
-	}, gpuDevices)
+	}, gpuDevices, nil, nil)
 
 	fmt.Println(event.StringToPrint())
 
 	// if len(events) != 2 {
 	// 	t.Fatal("no events")
 	// }
+
+	assignments, _ := event.GetValue("gpuassignments")
+	if !reflect.DeepEqual(assignments, []common.MapStr{
+		{"index": 0, "sources": []string{nvidiadocker.GPUSourceDeviceNode}},
+		{"index": 1, "sources": []string{nvidiadocker.GPUSourceDeviceNode}},
+	}) {
+		t.Fatalf("unexpected GPU assignments: %v", assignments)
+	}
+
+	if gpu, _ := event.GetValue("device.Utilization.GPU"); gpu != uint(22) {
+		t.Fatalf("expected the utilization of /dev/nvidia0 and /dev/nvidia1, got %v", gpu)
+	}
+
+	if devices, _ := event.GetValue("devices"); len(devices.([]common.MapStr)) != 2 {
+		t.Fatalf("expected an entry per assigned GPU, got %v", devices)
+	}
+	if gpu, _ := event.GetValue("utilization.gpu.normalized"); gpu != float64(11) {
+		t.Fatalf("expected the normalized utilization of both GPUs, got %v", gpu)
+	}
+	if gpu, _ := event.GetValue("aggregate.utilization.gpu"); !reflect.DeepEqual(gpu, common.MapStr{"avg": float64(11), "max": float64(12)}) {
+		t.Fatalf("unexpected GPU utilization aggregates: %v", gpu)
+	}
+	if pct, _ := event["devices"].([]common.MapStr)[1].GetValue("memory.used.pct"); pct != 0.3 {
+		t.Fatalf("unexpected used memory share of /dev/nvidia1: %v", pct)
+	}
+	if used, _ := event.GetValue("aggregate.memory.used.bytes"); !reflect.DeepEqual(used, common.MapStr{"avg": float64(2 * gibibyte), "max": float64(3 * gibibyte)}) {
+		t.Fatalf("unexpected used memory aggregates: %v", used)
+	}
+	if free, _ := event.GetValue("aggregate.memory.free.bytes.max"); free != float64(9*gibibyte) {
+		t.Fatalf("unexpected free memory aggregate: %v", free)
+	}
+	if pct, _ := event.GetValue("aggregate.memory.used.pct.max"); pct != 0.3 {
+		t.Fatalf("unexpected used memory share aggregate: %v", pct)
+	}
 }
 
-func TestGetGPUDeviceStatus(t *testing.T) {
-	output := `0, 45, 22919, 21227, 48
-	1, 100, 22919, 15945, 51
-	2, 98, 22919, 16457, 69
-	3, 100, 22919, 21211, 76
-	4, 100, 22919, 21649, 52
-	5, 100, 22919, 21639, 52
-	6, 100, 22919, 21269, 71
-	7, 100, 22919, 16231, 79
-`
-	predictDevicesStatus := []DeviceStatus{
-		{
-			Index: toUintP(0),
-			Utilization: UtilizationInfo{
-				GPU:    66,
-				Memory: 47,
-			},
-			Temperature: 27,
+func TestFetchFromContainerSparseDevices(t *testing.T) {
+	// Only GPUs 1 and 2 are reported, e.g. with `nvidia-smi -i 1,2`.
+	gpuDevices := []nvidiadocker.DeviceStatus{
+		{Index: toUintP(1), UUID: "GPU-66a2874a", Utilization: nvidiadocker.UtilizationInfo{GPU: 10}},
+		{Index: toUintP(2), UUID: "GPU-535c289c", Utilization: nvidiadocker.UtilizationInfo{GPU: 20}},
+	}
+
+	m := &MetricSet{aggregates: defaultAggregates}
+	for _, test := range []struct {
+		env  string
+		uuid string
+		gpu  uint
+	}{
+		{"NVIDIA_VISIBLE_DEVICES=1", "GPU-66a2874a", 10},
+		{"NVIDIA_VISIBLE_DEVICES=2", "GPU-535c289c", 20},
+	} {
+		event := m.fetchFromContainer(&nvidiadocker.Container{ID: "id1", Env: []string{test.env}}, gpuDevices, nil, nil)
+		devices, _ := event["devices"].([]common.MapStr)
+		if len(devices) != 1 || devices[0]["uuid"] != test.uuid {
+			t.Fatalf("expected %s for %s, got %v", test.uuid, test.env, devices)
+		}
+		if gpu, _ := event.GetValue("device.Utilization.GPU"); gpu != test.gpu {
+			t.Fatalf("expected the utilization of %s, got %v", test.uuid, gpu)
+		}
+	}
+}
+
+func TestContainerStatusAggregates(t *testing.T) {
+	cStatus := &ContainerStatus{}
+	for _, utilization := range []uint{95, 100, 90, 95} {
+		cStatus.AddDevice(&nvidiadocker.DeviceStatus{
+			Utilization: nvidiadocker.UtilizationInfo{GPU: utilization},
+			Temperature: utilization - 10,
+		})
+	}
+
+	gpu := func(device *nvidiadocker.DeviceStatus) uint {
+		return device.Utilization.GPU
+	}
+	if sum := cStatus.PropSum(gpu); sum != 380 {
+		t.Fatalf("expected a sum of 380, got %v", sum)
+	}
+	if normalized := cStatus.NormalizedUtilization(gpu); normalized != 95 {
+		t.Fatalf("expected a normalized utilization of 95, got %v", normalized)
+	}
+
+	aggregates := cStatus.PropAggregates([]string{"avg", "max", "min", "sum"}, func(device *nvidiadocker.DeviceStatus) float64 {
+		return float64(device.Temperature)
+	})
+	expected := common.MapStr{"avg": float64(85), "max": float64(90), "min": float64(80), "sum": float64(340)}
+	if !reflect.DeepEqual(aggregates, expected) {
+		t.Fatalf("expected %v, got %v", expected, aggregates)
+	}
+
+	if avg := (&ContainerStatus{}).PropAggregate("avg", func(device *nvidiadocker.DeviceStatus) float64 { return 1 }); avg != 0 {
+		t.Fatalf("expected 0 for a container without GPUs, got %v", avg)
+	}
+
+	if err := validateAggregates([]string{"avg", "p99"}); err == nil {
+		t.Fatal("expected an error for an unknown aggregate")
+	}
+}
+
+const gibibyte = 1024 * mebibyte
+
+func toUintP(val uint) *uint {
+	return &val
+}
+
+func TestProcessMemory(t *testing.T) {
+	gpuDevices := []nvidiadocker.DeviceStatus{
+		{Index: toUintP(0), UUID: "GPU-66a2874a-837d-cd53-ab26-0d2d842d9822"},
+		{Index: toUintP(1), UUID: "GPU-535c289c-6dd8-e308-b4ca-524b0fc07fa6"},
+	}
+
+	event := processMemory([]nvidiadocker.ContainerProcess{
+		{Device: &gpuDevices[1], Process: nvidiadocker.ProcessInfo{PID: 100, MemoryUsed: 1024}},
+		{Device: &gpuDevices[0], Process: nvidiadocker.ProcessInfo{PID: 101, MemoryUsed: 256}},
+		{Device: &gpuDevices[1], Process: nvidiadocker.ProcessInfo{PID: 102, MemoryUsed: 512}},
+	})
+
+	expected := common.MapStr{
+		"used": common.MapStr{
+			"bytes": uint64(1792 * mebibyte),
 		},
-		{
-			Index: toUintP(1),
-			Utilization: UtilizationInfo{
-				GPU:    10,
-				Memory: 14,
+		"devices": []common.MapStr{
+			{
+				"index": uint(1),
+				"uuid":  "GPU-535c289c-6dd8-e308-b4ca-524b0fc07fa6",
+				"used": common.MapStr{
+					"bytes": uint64(1536 * mebibyte),
+				},
+				"pids": []uint{100, 102},
 			},
-			Temperature: 25,
-		},
-		{
-			Index: toUintP(2),
-			Utilization: UtilizationInfo{
-				GPU:    37,
-				Memory: 0,
+			{
+				"index": uint(0),
+				"uuid":  "GPU-66a2874a-837d-cd53-ab26-0d2d842d9822",
+				"used": common.MapStr{
+					"bytes": uint64(256 * mebibyte),
+				},
+				"pids": []uint{101},
 			},
-			Temperature: 33,
 		},
-		{
-			Index: toUintP(3),
-			Utilization: UtilizationInfo{
-				GPU:    0,
-				Memory: 0,
-			},
-			Temperature: 22,
+	}
+	if !reflect.DeepEqual(event, expected) {
+		t.Fatalf("unexpected process memory: %v", event.StringToPrint())
+	}
+}
+
+func TestFetchFromContainersPerPod(t *testing.T) {
+	gpuDevices := []nvidiadocker.DeviceStatus{
+		{Index: toUintP(0), Utilization: nvidiadocker.UtilizationInfo{GPU: 10}},
+		{Index: toUintP(1), Utilization: nvidiadocker.UtilizationInfo{GPU: 20}},
+	}
+
+	podContainer := func(id, containerName string, env []string, labels map[string]string) *nvidiadocker.Container {
+		containerLabels := map[string]string{
+			"io.kubernetes.container.name": containerName,
+			"io.kubernetes.pod.name":       "train-0",
+			"io.kubernetes.pod.namespace":  "ml",
+			"io.kubernetes.pod.uid":        "535c289c-6dd8-e308-b4ca-524b0fc07fa6",
+		}
+		for k, v := range labels {
+			containerLabels[k] = v
+		}
+		return &nvidiadocker.Container{
+			ID:     id,
+			Name:   "k8s_" + containerName + "_train-0_ml_535c289c-6dd8-e308-b4ca-524b0fc07fa6_0",
+			Env:    env,
+			Labels: containerLabels,
+		}
+	}
+	containers := []*nvidiadocker.Container{
+		podContainer("sandbox", "POD", nil, map[string]string{"io.kubernetes.docker.type": "podsandbox"}),
+		podContainer("trainer", "trainer", []string{"NVIDIA_VISIBLE_DEVICES=0"}, map[string]string{"io.kubernetes.docker.type": "container"}),
+		podContainer("sidecar", "sidecar", []string{"NVIDIA_VISIBLE_DEVICES=0,1"}, map[string]string{"io.kubernetes.docker.type": "container"}),
+		{ID: "plain", Name: "plain"},
+	}
+
+	m := &MetricSet{procPath: "/nonexistent"}
+	events, err := m.fetchFromContainers(containers, gpuDevices, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 4-1 {
+		t.Fatalf("expected an event per container without the sandbox, got %d", len(events))
+	}
+	if name, _ := events[0].GetValue("kubernetes.container.name"); name != "trainer" {
+		t.Fatalf("expected the trainer container, got %v", name)
+	}
+	if _, err := events[2].GetValue("kubernetes"); err == nil {
+		t.Fatal("expected no kubernetes metadata for a plain container")
+	}
+
+	m.perPod = true
+	events, err = m.fetchFromContainers(containers, gpuDevices, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected an event for the plain container and the pod, got %d", len(events))
+	}
+
+	pod := events[1]
+	expected := common.MapStr{
+		"pod": common.MapStr{
+			"name": "train-0",
+			"uid":  "535c289c-6dd8-e308-b4ca-524b0fc07fa6",
 		},
-		{
-			Index: toUintP(4),
-			Utilization: UtilizationInfo{
-				GPU:    0,
-				Memory: 0,
-			},
-			Temperature: 16,
+		"namespace": "ml",
+		"container": common.MapStr{
+			"name": []string{"trainer", "sidecar"},
 		},
-		{
-			Index: toUintP(5),
-			Utilization: UtilizationInfo{
-				GPU:    44,
-				Memory: 20,
+	}
+	if kubernetes, _ := pod.GetValue("kubernetes"); !reflect.DeepEqual(kubernetes, expected) {
+		t.Fatalf("unexpected kubernetes metadata: %v", kubernetes)
+	}
+	if ids, _ := pod.GetValue("containerid"); !reflect.DeepEqual(ids, []string{"trainer", "sidecar"}) {
+		t.Fatalf("unexpected container IDs: %v", ids)
+	}
+	if gpu, _ := pod.GetValue("device.Utilization.GPU"); gpu != uint(30) {
+		t.Fatalf("expected the utilization of both GPUs counted once, got %v", gpu)
+	}
+	if labels, _ := pod.GetValue("labels"); !reflect.DeepEqual(labels, map[string]string{
+		"io.kubernetes.docker.type":   "container",
+		"io.kubernetes.pod.name":      "train-0",
+		"io.kubernetes.pod.namespace": "ml",
+		"io.kubernetes.pod.uid":       "535c289c-6dd8-e308-b4ca-524b0fc07fa6",
+	}) {
+		t.Fatalf("expected the labels shared by the pod's containers, got %v", labels)
+	}
+}
+
+func TestFetchFromContainersGPUOnly(t *testing.T) {
+	gpuDevices := []nvidiadocker.DeviceStatus{
+		{Index: toUintP(0), Utilization: nvidiadocker.UtilizationInfo{GPU: 10}},
+	}
+	podLabels := func(containerName string) map[string]string {
+		return map[string]string{
+			"io.kubernetes.container.name": containerName,
+			"io.kubernetes.pod.name":       "train-0",
+			"io.kubernetes.pod.namespace":  "ml",
+			"io.kubernetes.pod.uid":        "535c289c-6dd8-e308-b4ca-524b0fc07fa6",
+		}
+	}
+	containers := []*nvidiadocker.Container{
+		{ID: "gpu", Name: "gpu", Env: []string{"NVIDIA_VISIBLE_DEVICES=0"}},
+		{ID: "cpu", Name: "cpu"},
+		{ID: "trainer", Name: "trainer", Env: []string{"NVIDIA_VISIBLE_DEVICES=0"}, Labels: podLabels("trainer")},
+		{ID: "sidecar", Name: "sidecar", Labels: podLabels("sidecar")},
+	}
+
+	m := &MetricSet{procPath: "/nonexistent", gpuOnly: true}
+	events, err := m.fetchFromContainers(containers, gpuDevices, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []interface{}
+	for _, event := range events {
+		ids = append(ids, event["containerid"])
+	}
+	if !reflect.DeepEqual(ids, []interface{}{"gpu", "trainer"}) {
+		t.Fatalf("expected only the containers with GPUs, got %v", ids)
+	}
+
+	// A pod is reported with all its containers if any of them has a GPU.
+	m.perPod = true
+	events, err = m.fetchFromContainers(containers, gpuDevices, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || !reflect.DeepEqual(events[1]["containerid"], []string{"trainer", "sidecar"}) {
+		t.Fatalf("expected the GPU container and the pod, got %v", events)
+	}
+}
+
+type fakeRuntime struct {
+	containers []*nvidiadocker.Container
+	err        error
+}
+
+func (r *fakeRuntime) Containers() ([]*nvidiadocker.Container, error) {
+	return r.containers, r.err
+}
+
+func (r *fakeRuntime) ExcludedContainerIDs() []string {
+	return nil
+}
+
+type fakeDeviceBackend []nvidiadocker.DeviceStatus
+
+func (b fakeDeviceBackend) DeviceStatuses() ([]nvidiadocker.DeviceStatus, error) {
+	return b, nil
+}
+
+func TestFetchPartial(t *testing.T) {
+	m := &MetricSet{
+		containers: &fakeRuntime{
+			containers: []*nvidiadocker.Container{
+				{ID: "4e3bb646c7ff", Name: "trainer", Env: []string{"NVIDIA_VISIBLE_DEVICES=0"}},
 			},
-			Temperature: 36,
-		},
-		{
-			Index: toUintP(6),
-			Utilization: UtilizationInfo{
-				GPU:    0,
-				Memory: 0,
+			err: &nvidiadocker.InspectError{
+				TimedOut: []string{"ca766152aa55"},
+				Failed: []nvidiadocker.ContainerError{
+					{ID: "d3b07384d113", Name: "notebook", Err: fmt.Errorf("unexpected EOF")},
+				},
 			},
-			Temperature: 17,
 		},
-		{
-			Index: toUintP(7),
-			Utilization: UtilizationInfo{
-				GPU:    20,
-				Memory: 3,
-			},
-			Temperature: 27,
+		deviceBackend: fakeDeviceBackend{
+			{Index: toUintP(0), InvalidFields: []string{"temperature.gpu", "power.draw"}},
+			{Index: toUintP(1), InvalidFields: []string{"temperature.gpu"}},
 		},
+		aggregates: defaultAggregates,
+		hostName:   "gpu-1",
 	}
-	devicesStatus, err := getGPUDeviceStatus(output)
+
+	events, err := m.Fetch()
 	if err != nil {
 		t.Fatal(err)
 	}
-	fmt.Print("devicesStatus", devicesStatus)
 
-	if !reflect.DeepEqual(devicesStatus, predictDevicesStatus) {
-		t.Fatal("failed")
+	// The inspected container, an error event per skipped container and the
+	// summary.
+	if len(events) != 4 {
+		t.Fatalf("expected 4 events, got %d: %v", len(events), events)
+	}
+	if id := events[0]["containerid"]; id != "4e3bb646c7ff" {
+		t.Fatalf("expected the inspected container first, got %v", events[0])
 	}
-}
 
-func TestGetNvidiaVisibleDevices(t *testing.T) {
-	tests := []struct {
-		ENV    []string
-		Result []int
-	}{
-		{
-			ENV:    []string{"NVIDIA_VISIBLE_DEVICES=3"},
-			Result: []int{3},
-		},
-		{
-			ENV:    []string{"NVIDIA_VISIBLE_DEVICES=0,1,2,3"},
-			Result: []int{0, 1, 2, 3},
-		},
-		{
-			ENV:    []string{"NVIDIA_VISIBLE_DEVICES=5,1"},
-			Result: []int{5, 1},
+	timedOut, failed := events[1], events[2]
+	if timedOut["containerid"] != "ca766152aa55" || failed["containerid"] != "d3b07384d113" || failed["containername"] != "notebook" {
+		t.Fatalf("unexpected error events %v and %v", timedOut, failed)
+	}
+	if message, _ := failed.GetValue("error.message"); message != "unexpected EOF" {
+		t.Fatalf("expected the reason of the failure, got %v", message)
+	}
+
+	expected := common.MapStr{
+		"reported": common.MapStr{"count": 1},
+		"skipped":  common.MapStr{"count": 2},
+		"timedout": common.MapStr{"count": 1, "containerids": []string{"ca766152aa55"}},
+		"failed":   common.MapStr{"count": 1, "containerids": []string{"d3b07384d113"}},
+		"gpus": common.MapStr{
+			"count": 2,
+			"invalidfields": common.MapStr{
+				"count": 3,
+				"names": []string{"temperature.gpu", "power.draw"},
+			},
 		},
+	}
+	if summary := events[3]["fetch"]; !reflect.DeepEqual(summary, expected) {
+		t.Fatalf("expected the summary %v, got %v", expected, summary)
+	}
+	for _, event := range events {
+		if host, _ := event.GetValue("_module.host"); host != "gpu-1" {
+			t.Fatalf("expected every event to be tagged with the host, got %v", event)
+		}
+	}
+
+	// A complete fetch still ends with the summary.
+	m.containers = &fakeRuntime{}
+	m.deviceBackend = fakeDeviceBackend{}
+	events, err = m.Fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected only the summary, got %v", events)
+	}
+	if skipped, _ := events[0].GetValue("fetch.skipped.count"); skipped != 0 {
+		t.Fatalf("expected nothing skipped, got %v", skipped)
+	}
+}
+
+func TestProcessLabels(t *testing.T) {
+	labels, err := nvidiadocker.NewLabelProcessor(nvidiadocker.Config{
+		LabelDedot:  true,
+		LabelDeny:   []string{"team"},
+		LabelFields: map[string]string{"team": "team"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &MetricSet{labels: labels}
+	events := []common.MapStr{
 		{
-			ENV:    []string{"ABC=BCD"},
-			Result: []int{},
+			"containerid": "4e3bb646c7ff",
+			"labels":      map[string]string{"com.nvidia.cuda.version": "8.0.61", "team": "vision"},
 		},
+		{"consistency": common.MapStr{"type": "unclaimed_gpu"}},
 	}
-	for _, test := range tests {
-		deviceIndices := getNvidiaDevicesFromEnvs(test.ENV)
-		if !reflect.DeepEqual(deviceIndices, test.Result) {
-			t.Fatal("failed")
-		}
+	m.processLabels(events)
+
+	expected := common.MapStr{
+		"containerid": "4e3bb646c7ff",
+		"labels":      map[string]string{"com_nvidia_cuda_version": "8.0.61"},
+		"team":        "vision",
+	}
+	if !reflect.DeepEqual(events[0], expected) {
+		t.Fatalf("expected %v, got %v", expected, events[0])
+	}
+	if _, found := events[1]["team"]; found {
+		t.Fatal("expected events without labels to be left as they are")
 	}
 }
@@ -0,0 +1,62 @@
+package xid
+
+// Severities of Xid errors.
+const (
+	// The error is reported for information, e.g. the cleanup after an
+	// earlier error.
+	severityInfo = "info"
+	// The error is usually caused by the application, e.g. an illegal memory
+	// access, and doesn't affect other applications on the GPU.
+	severityWarning = "warning"
+	// The error points at a driver or hardware problem of the GPU which may
+	// recover.
+	severityError = "error"
+	// The GPU needs to be reset or drained, e.g. after a double bit ECC
+	// error or when it has fallen off the bus.
+	severityCritical = "critical"
+	// The Xid code is not in the table of known codes.
+	severityUnknown = "unknown"
+)
+
+type xidCode struct {
+	severity    string
+	description string
+}
+
+// xidCodes are the known Xid codes, see
+// https://docs.nvidia.com/deploy/xid-errors/index.html.
+var xidCodes = map[int]xidCode{
+	8:   {severityError, "GPU stopped processing"},
+	13:  {severityWarning, "Graphics engine exception"},
+	31:  {severityWarning, "GPU memory page fault"},
+	32:  {severityWarning, "Invalid or corrupted push buffer stream"},
+	38:  {severityError, "Driver firmware error"},
+	43:  {severityWarning, "GPU stopped processing"},
+	44:  {severityError, "Graphics engine fault during context switch"},
+	45:  {severityInfo, "Preemptive cleanup, due to previous errors"},
+	48:  {severityCritical, "Double bit ECC error"},
+	56:  {severityError, "Display engine error"},
+	57:  {severityError, "Error programming video memory interface"},
+	58:  {severityError, "Unstable video memory interface detected"},
+	61:  {severityError, "Internal micro-controller breakpoint/warning"},
+	62:  {severityCritical, "Internal micro-controller halt"},
+	63:  {severityWarning, "ECC page retirement or row remapping recording event"},
+	64:  {severityCritical, "ECC page retirement or row remapper recording failure"},
+	68:  {severityWarning, "Video processor exception"},
+	69:  {severityWarning, "Graphics engine class error"},
+	74:  {severityCritical, "NVLink error"},
+	79:  {severityCritical, "GPU has fallen off the bus"},
+	92:  {severityWarning, "High single-bit ECC error rate"},
+	94:  {severityError, "Contained ECC error"},
+	95:  {severityCritical, "Uncontained ECC error"},
+	119: {severityCritical, "GSP RPC timeout"},
+	120: {severityCritical, "GSP error"},
+}
+
+// lookupXidCode returns the severity and description of a Xid code.
+func lookupXidCode(code int) xidCode {
+	if known, found := xidCodes[code]; found {
+		return known
+	}
+	return xidCode{severity: severityUnknown}
+}
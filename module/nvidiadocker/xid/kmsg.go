@@ -0,0 +1,311 @@
+package xid
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+const (
+	// maxPendingErrors bounds the Xid errors kept between two fetches.
+	maxPendingErrors = 1000
+	// kmsgPollWait is how long to wait for new lines at the end of a regular
+	// file. Reads of /dev/kmsg block until a new record is logged.
+	kmsgPollWait = time.Second
+	// kmsgIdlePeriods is the number of periods without a fetch after which
+	// the kernel log is closed. It leaves room for fetches stalled by a GPU
+	// which doesn't answer, so Xid errors aren't missed meanwhile.
+	kmsgIdlePeriods = 10
+)
+
+var (
+	// xidRegexp matches the Xid errors logged by the NVIDIA driver, e.g.
+	// `NVRM: Xid (PCI:0000:08:00): 79, pid=1234, GPU has fallen off the bus.`
+	xidRegexp        = regexp.MustCompile(`NVRM: Xid \(PCI:([0-9a-fA-F:.]+)\): (\d+),\s*(.*)`)
+	xidPIDRegexp     = regexp.MustCompile(`\bpid=(\d+)`)
+	xidProcessRegexp = regexp.MustCompile(`\bname=([^,]+)`)
+)
+
+// xidError is a Xid error parsed from the kernel log.
+type xidError struct {
+	code    int
+	busID   string
+	message string
+	pid     uint
+	process string
+	// uptime is the time since boot the record was logged at, if known.
+	uptime time.Duration
+}
+
+// kmsgTailer reads the Xid errors logged to the kernel log from the time it
+// is started and keeps them until they are fetched. Metricbeat doesn't close
+// its metricsets, so the tailer closes the kernel log when its errors aren't
+// fetched for its idle timeout, and opens it again on the next fetch.
+type kmsgTailer struct {
+	path        string
+	pollWait    time.Duration
+	idleTimeout time.Duration
+
+	mu          sync.Mutex
+	file        *os.File
+	done        chan struct{}
+	stopped     chan struct{}
+	lastFetched time.Time
+	pending     []xidError
+}
+
+// newKmsgTailer opens the kernel log at path and starts reading it from its
+// end, so Xid errors logged before are not reported. pollWait is how long to
+// wait for new lines at the end of a regular file. The kernel log is closed
+// when the errors aren't fetched for idleTimeout, unless it is 0.
+func newKmsgTailer(path string, pollWait, idleTimeout time.Duration) (*kmsgTailer, error) {
+	t := &kmsgTailer{
+		path:        path,
+		pollWait:    pollWait,
+		idleTimeout: idleTimeout,
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.open(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// open opens the kernel log and starts reading it from its end. It must be
+// called with the lock held.
+func (t *kmsgTailer) open() error {
+	file, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to seek to the end of %s: %v", t.path, err)
+	}
+
+	t.file = file
+	t.done = make(chan struct{})
+	t.stopped = make(chan struct{})
+	t.lastFetched = time.Now()
+	go t.run(file, t.done, t.stopped)
+	if t.idleTimeout > 0 {
+		go t.closeWhenIdle(t.done)
+	}
+	return nil
+}
+
+// Close stops reading the kernel log and closes it. Closing /dev/kmsg also
+// ends a read waiting for a new record.
+func (t *kmsgTailer) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.close()
+}
+
+// close closes the kernel log if it is open. It must be called with the lock
+// held.
+func (t *kmsgTailer) close() error {
+	if t.file == nil {
+		return nil
+	}
+	close(t.done)
+	err := t.file.Close()
+	t.file = nil
+	return err
+}
+
+// closeWhenIdle closes the kernel log when the errors weren't fetched for the
+// idle timeout, e.g. after a config reload stopped the metricset.
+func (t *kmsgTailer) closeWhenIdle(done <-chan struct{}) {
+	ticker := time.NewTicker(t.idleTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			t.mu.Lock()
+			if time.Since(t.lastFetched) >= t.idleTimeout {
+				logp.Debug("nvidiadocker", "the Xid errors weren't fetched for %v, closing %s", t.idleTimeout, t.path)
+				t.close()
+				t.mu.Unlock()
+				return
+			}
+			t.mu.Unlock()
+		}
+	}
+}
+
+// Errors returns the Xid errors read since the last call. If the kernel log
+// was closed while the errors weren't fetched, it is opened again, and the
+// errors logged meanwhile are not reported.
+func (t *kmsgTailer) Errors() []xidError {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.lastFetched = time.Now()
+	if t.file == nil {
+		if err := t.open(); err != nil {
+			logp.Err("nvidiadocker: failed to open the kernel log %s again: %v", t.path, err)
+		}
+	}
+
+	errors := t.pending
+	t.pending = nil
+	return errors
+}
+
+// run reads the kernel log until done is closed and closes stopped when it
+// returns.
+func (t *kmsgTailer) run(file *os.File, done <-chan struct{}, stopped chan<- struct{}) {
+	defer close(stopped)
+
+	var (
+		reader  = bufio.NewReader(file)
+		partial string
+	)
+	for {
+		line, err := reader.ReadString('\n')
+		partial += line
+		if err == nil {
+			t.handleLine(partial)
+			partial = ""
+			continue
+		}
+
+		switch {
+		case isDone(done):
+			return
+		case err == io.EOF:
+			// The end of a regular file, wait for it to grow.
+			t.wait(done)
+		case isEPIPE(err):
+			// The kernel overwrote records before they were read, reading
+			// continues with the oldest record still available.
+			logp.Debug("nvidiadocker", "kernel log records were overwritten before being read")
+			partial = ""
+		default:
+			logp.Err("nvidiadocker: failed to read the kernel log %s: %v", t.path, err)
+			t.wait(done)
+		}
+	}
+}
+
+func isDone(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait waits for the poll wait or until done is closed.
+func (t *kmsgTailer) wait(done <-chan struct{}) {
+	select {
+	case <-time.After(t.pollWait):
+	case <-done:
+	}
+}
+
+func (t *kmsgTailer) handleLine(line string) {
+	xid, ok := parseKmsgLine(line)
+	if !ok {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pending) >= maxPendingErrors {
+		logp.Warn("nvidiadocker: dropping Xid error %d of %s, %d errors are pending", xid.code, xid.busID, len(t.pending))
+		return
+	}
+	t.pending = append(t.pending, xid)
+}
+
+// parseKmsgLine parses a Xid error from a /dev/kmsg record like
+// `3,1024,5123456789,-;NVRM: Xid (PCI:0000:08:00): 79, GPU has fallen off the bus.`
+// or from a plain kernel log line.
+func parseKmsgLine(line string) (xidError, bool) {
+	line = strings.TrimRight(line, "\r\n")
+
+	var uptime time.Duration
+	if sep := strings.Index(line, ";"); sep >= 0 {
+		if header := strings.Split(line[:sep], ","); len(header) >= 3 {
+			if usec, err := strconv.ParseUint(header[2], 10, 64); err == nil {
+				uptime = time.Duration(usec) * time.Microsecond
+				line = line[sep+1:]
+			}
+		}
+	}
+
+	matches := xidRegexp.FindStringSubmatch(line)
+	if matches == nil {
+		return xidError{}, false
+	}
+	code, err := strconv.Atoi(matches[2])
+	if err != nil {
+		return xidError{}, false
+	}
+
+	xid := xidError{
+		code:    code,
+		busID:   matches[1],
+		message: strings.TrimSpace(matches[3]),
+		uptime:  uptime,
+	}
+	if pid := xidPIDRegexp.FindStringSubmatch(xid.message); pid != nil {
+		if val, err := strconv.ParseUint(pid[1], 10, 32); err == nil {
+			xid.pid = uint(val)
+		}
+	}
+	if process := xidProcessRegexp.FindStringSubmatch(xid.message); process != nil {
+		xid.process = strings.TrimSpace(process[1])
+	}
+	return xid, true
+}
+
+func isEPIPE(err error) bool {
+	if pathErr, ok := err.(*os.PathError); ok {
+		return pathErr.Err == syscall.EPIPE
+	}
+	return err == syscall.EPIPE
+}
+
+// normalizePCIBusID returns the domain, bus and device of a PCI bus ID as
+// `dddd:bb:dd`, so the IDs logged by the driver (`0000:08:00`), reported by
+// nvidia-smi (`00000000:08:00.0`) and by nvidia-docker-plugin (`0000:08:00.0`)
+// compare equal.
+func normalizePCIBusID(busID string) string {
+	if dot := strings.LastIndex(busID, "."); dot >= 0 {
+		busID = busID[:dot]
+	}
+	parts := strings.Split(busID, ":")
+	if len(parts) == 2 {
+		parts = append([]string{"0"}, parts...)
+	}
+	if len(parts) != 3 {
+		return strings.ToLower(busID)
+	}
+
+	values := make([]uint64, len(parts))
+	for i, part := range parts {
+		val, err := strconv.ParseUint(part, 16, 32)
+		if err != nil {
+			return strings.ToLower(busID)
+		}
+		values[i] = val
+	}
+	return fmt.Sprintf("%04x:%02x:%02x", values[0], values[1], values[2])
+}
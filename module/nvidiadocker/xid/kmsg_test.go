@@ -0,0 +1,160 @@
+package xid
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseKmsgLine(t *testing.T) {
+	tests := []struct {
+		Line string
+		Xid  *xidError
+	}{
+		{
+			Line: "3,1024,5123456789,-;NVRM: Xid (PCI:0000:08:00): 79, pid=1234, name=python, GPU has fallen off the bus.\n",
+			Xid: &xidError{
+				code:    79,
+				busID:   "0000:08:00",
+				message: "pid=1234, name=python, GPU has fallen off the bus.",
+				pid:     1234,
+				process: "python",
+				uptime:  5123456789 * time.Microsecond,
+			},
+		},
+		{
+			Line: "[ 1234.567890] NVRM: Xid (PCI:0000:0b:00): 13, Graphics SM Warp Exception on (GPC 0, TPC 1): Out Of Range Address",
+			Xid: &xidError{
+				code:    13,
+				busID:   "0000:0b:00",
+				message: "Graphics SM Warp Exception on (GPC 0, TPC 1): Out Of Range Address",
+			},
+		},
+		{
+			Line: "6,1025,5123456790,-;nvidia-nvlink: Nvlink Core is being initialized\n",
+		},
+		{
+			Line: " SUBSYSTEM=pci\n",
+		},
+	}
+
+	for _, test := range tests {
+		xid, ok := parseKmsgLine(test.Line)
+		if ok != (test.Xid != nil) {
+			t.Fatalf("expected a Xid error %v for '%s', got %v", test.Xid != nil, test.Line, ok)
+		}
+		if ok && !reflect.DeepEqual(xid, *test.Xid) {
+			t.Fatalf("expected %+v, got %+v", *test.Xid, xid)
+		}
+	}
+}
+
+func TestNormalizePCIBusID(t *testing.T) {
+	for _, busID := range []string{"0000:08:00", "00000000:08:00.0", "0000:08:00.0", "08:00.0"} {
+		if normalized := normalizePCIBusID(busID); normalized != "0000:08:00" {
+			t.Fatalf("expected 0000:08:00 for %s, got %s", busID, normalized)
+		}
+	}
+	if normalizePCIBusID("0000:0B:00.0") != normalizePCIBusID("0000:0b:00") {
+		t.Fatal("expected the bus ID to be case insensitive")
+	}
+}
+
+func TestKmsgTailer(t *testing.T) {
+	file, err := ioutil.TempFile("", "kmsg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	// Errors logged before the tailer is started are not reported.
+	if _, err := file.WriteString("3,1,100,-;NVRM: Xid (PCI:0000:08:00): 48, An uncorrectable double bit error\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	tailer, err := newKmsgTailer(file.Name(), 10*time.Millisecond, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := []string{
+		"6,2,200,-;nvidia-modeset: Allocated GPU:0\n",
+		"3,3,300,-;NVRM: Xid (PCI:0000:08:00): 79, GPU has fallen off the bus.\n",
+		"3,4,400,-;NVRM: Xid (PCI:0000:0b:00): 31, pid=42, Ch 00000010, intr 10000000. MMU Fault\n",
+	}
+	for _, line := range lines {
+		if _, err := file.WriteString(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var codes []int
+	for deadline := time.Now().Add(5 * time.Second); len(codes) < 2 && time.Now().Before(deadline); {
+		for _, xid := range tailer.Errors() {
+			codes = append(codes, xid.code)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !reflect.DeepEqual(codes, []int{79, 31}) {
+		t.Fatalf("expected the Xid errors 79 and 31, got %v", codes)
+	}
+	if errors := tailer.Errors(); len(errors) != 0 {
+		t.Fatalf("expected the errors to be fetched once, got %v", errors)
+	}
+
+	stopped := tailer.stopped
+	if err := tailer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the tailer to stop reading after close")
+	}
+}
+
+func TestKmsgTailerIdle(t *testing.T) {
+	file, err := ioutil.TempFile("", "kmsg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	tailer, err := newKmsgTailer(file.Name(), 10*time.Millisecond, 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tailer.Close()
+
+	tailer.mu.Lock()
+	stopped := tailer.stopped
+	tailer.mu.Unlock()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the tailer to stop reading when its errors aren't fetched")
+	}
+
+	// The next fetch reads the kernel log again from its end.
+	if _, err := file.WriteString("3,1,100,-;NVRM: Xid (PCI:0000:08:00): 48, An uncorrectable double bit error\n"); err != nil {
+		t.Fatal(err)
+	}
+	tailer.Errors()
+	if _, err := file.WriteString("3,2,200,-;NVRM: Xid (PCI:0000:08:00): 79, GPU has fallen off the bus.\n"); err != nil {
+		t.Fatal(err)
+	}
+	var codes []int
+	for deadline := time.Now().Add(5 * time.Second); len(codes) < 1 && time.Now().Before(deadline); {
+		for _, xid := range tailer.Errors() {
+			codes = append(codes, xid.code)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !reflect.DeepEqual(codes, []int{79}) {
+		t.Fatalf("expected the Xid error logged after the tailer was opened again, got %v", codes)
+	}
+}
@@ -0,0 +1,183 @@
+package xid
+
+import (
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/elastic/beats/metricbeat/mb"
+	"github.com/fpgeek/nvidiadockerbeat/module/nvidiadocker"
+)
+
+// init registers the MetricSet with the central registry.
+// The New method will be called after the setup of the module and before starting to fetch data
+func init() {
+	if err := mb.Registry.AddMetricSet("nvidiadocker", "xid", New); err != nil {
+		panic(err)
+	}
+}
+
+// MetricSet reports the Xid errors the NVIDIA driver logged to the kernel log
+// since the last fetch, together with the GPU and the containers it is
+// assigned to.
+type MetricSet struct {
+	mb.BaseMetricSet
+	containers    nvidiadocker.Runtime
+	deviceBackend nvidiadocker.DeviceStatusBackend
+	kubeletPath   string
+	kmsg          *kmsgTailer
+	hostName      string
+}
+
+// New create a new instance of the MetricSet
+func New(base mb.BaseMetricSet) (mb.MetricSet, error) {
+	cfg := nvidiadocker.DefaultConfig()
+	if err := base.Module().UnpackConfig(&cfg); err != nil {
+		return nil, err
+	}
+	if !nvidiadocker.IsLocalHost(base.Host()) {
+		// The module may also collect from remote hosts, whose kernel log
+		// can't be read, so the metricset is loaded without reporting.
+		logp.Warn("nvidiadocker: the xid metricset only reads the kernel log of the local host and reports nothing for the remote host '%s'", base.Host())
+		return &MetricSet{BaseMetricSet: base}, nil
+	}
+
+	runtime, err := nvidiadocker.NewRuntime(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	deviceBackend, err := nvidiadocker.NewDeviceStatusBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	kmsg, err := newKmsgTailer(cfg.KmsgPath, kmsgPollWait, kmsgIdlePeriods*cfg.Period)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MetricSet{
+		BaseMetricSet: base,
+		containers:    runtime,
+		deviceBackend: deviceBackend,
+		kubeletPath:   cfg.KubeletCheckpoint,
+		kmsg:          kmsg,
+		hostName:      nvidiadocker.HostName(base.Host()),
+	}, nil
+}
+
+// Close stops reading the kernel log and releases the GPU status backend. It
+// is only used by the tests, as metricbeat doesn't close its metricsets; in
+// the beat the kernel log is closed once the metricset stops fetching.
+func (m *MetricSet) Close() error {
+	if m.kmsg == nil {
+		return nil
+	}
+	kmsgErr := m.kmsg.Close()
+	if err := nvidiadocker.CloseDeviceStatusBackend(m.deviceBackend); err != nil {
+		return err
+	}
+	return kmsgErr
+}
+
+// Fetch returns one event per Xid error logged since the last fetch. The
+// errors are reported even if the GPUs or containers can't be listed, as the
+// GPU may be the cause.
+func (m *MetricSet) Fetch() ([]common.MapStr, error) {
+	if m.kmsg == nil {
+		return []common.MapStr{}, nil
+	}
+	xidErrors := m.kmsg.Errors()
+	if len(xidErrors) == 0 {
+		return []common.MapStr{}, nil
+	}
+
+	gpuDevices, err := m.deviceBackend.DeviceStatuses()
+	if err != nil {
+		logp.Warn("nvidiadocker: failed to get the GPU status for Xid errors: %v", err)
+	}
+
+	var containers []*nvidiadocker.Container
+	if len(gpuDevices) > 0 {
+		containers, err = m.containers.Containers()
+		if err != nil {
+			logp.Warn("nvidiadocker: failed to list the containers for Xid errors: %v", err)
+		}
+	}
+
+	kubeletAllocations, err := nvidiadocker.ReadKubeletCheckpoint(m.kubeletPath)
+	if err != nil {
+		logp.Warn("nvidiadocker: failed to read the kubelet checkpoint %s: %v", m.kubeletPath, err)
+	}
+
+	events := fetchFromXidErrors(xidErrors, gpuDevices, containers, kubeletAllocations)
+	return nvidiadocker.TagHost(events, m.hostName), nil
+}
+
+func fetchFromXidErrors(xidErrors []xidError, gpuDevices []nvidiadocker.DeviceStatus, containers []*nvidiadocker.Container, kubeletAllocations nvidiadocker.KubeletAllocations) []common.MapStr {
+	devicesByBusID := make(map[string]int, len(gpuDevices))
+	for i, device := range gpuDevices {
+		if device.PCI.BusID != "" {
+			devicesByBusID[normalizePCIBusID(device.PCI.BusID)] = i
+		}
+	}
+
+	assignedContainers := make(map[int][]*nvidiadocker.Container, len(gpuDevices))
+	for _, container := range containers {
+		if nvidiadocker.IsPodSandbox(container.Labels) {
+			continue
+		}
+		for _, deviceIndex := range nvidiadocker.GetGPUDeviceIndices(container, gpuDevices, kubeletAllocations) {
+			assignedContainers[deviceIndex] = append(assignedContainers[deviceIndex], container)
+		}
+	}
+
+	events := make([]common.MapStr, 0, len(xidErrors))
+	for _, xid := range xidErrors {
+		code := lookupXidCode(xid.code)
+		event := common.MapStr{
+			"code":        xid.code,
+			"severity":    code.severity,
+			"description": code.description,
+			"message":     xid.message,
+			"pci": common.MapStr{
+				"busid": xid.busID,
+			},
+		}
+		if xid.uptime > 0 {
+			event["uptime"] = common.MapStr{"us": xid.uptime.Nanoseconds() / 1000}
+		}
+		if xid.pid != 0 || xid.process != "" {
+			event["process"] = common.MapStr{
+				"pid":  xid.pid,
+				"name": xid.process,
+			}
+		}
+
+		containerIDs := []string{}
+		containerNames := []string{}
+		if i, found := devicesByBusID[normalizePCIBusID(xid.busID)]; found {
+			device := gpuDevices[i]
+			deviceIndex := i
+			if device.Index != nil {
+				deviceIndex = int(*device.Index)
+			}
+			event["gpu"] = common.MapStr{
+				"index": deviceIndex,
+				"uuid":  device.UUID,
+			}
+
+			for _, container := range assignedContainers[deviceIndex] {
+				containerIDs = append(containerIDs, container.ID)
+				containerNames = append(containerNames, container.Name)
+			}
+		}
+		event["containers"] = common.MapStr{
+			"count": len(containerIDs),
+			"ids":   containerIDs,
+			"names": containerNames,
+		}
+
+		events = append(events, event)
+	}
+	return events
+}
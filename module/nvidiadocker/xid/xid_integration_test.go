@@ -0,0 +1,49 @@
+//go:build integration
+// +build integration
+
+package xid
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	mbtest "github.com/elastic/beats/metricbeat/mb/testing"
+)
+
+// TestData expects the dev mock of nvidia-docker-plugin (dev/main.go) on
+// localhost:3476 and a Docker daemon on the default socket. The Xid error is
+// logged to a file standing in for /dev/kmsg.
+func TestData(t *testing.T) {
+	kmsg, err := ioutil.TempFile("", "kmsg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(kmsg.Name())
+	defer kmsg.Close()
+
+	f := mbtest.NewEventsFetcher(t, getConfig(kmsg.Name()))
+
+	if _, err := kmsg.WriteString("3,1024,5123456789,-;NVRM: Xid (PCI:0000:08:00): 79, pid=1234, name=python, GPU has fallen off the bus.\n"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * kmsgPollWait)
+
+	err = mbtest.WriteEvents(f, t)
+	if err != nil {
+		t.Fatal("write", err)
+	}
+}
+
+func getConfig(kmsgPath string) map[string]interface{} {
+	return map[string]interface{}{
+		"module":         "nvidiadocker",
+		"metricsets":     []string{"xid"},
+		"hosts":          []string{"localhost"},
+		"apiurl":         "http://localhost:3476",
+		"gpubackend":     "plugin",
+		"dockerendpoint": "unix:///var/run/docker.sock",
+		"kmsgpath":       kmsgPath,
+	}
+}
@@ -0,0 +1,89 @@
+package xid
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/elastic/beats/libbeat/common"
+	mbtest "github.com/elastic/beats/metricbeat/mb/testing"
+	"github.com/fpgeek/nvidiadockerbeat/module/nvidiadocker"
+)
+
+func TestFetchRemoteHost(t *testing.T) {
+	f := mbtest.NewEventsFetcher(t, map[string]interface{}{
+		"module":     "nvidiadocker",
+		"metricsets": []string{"xid"},
+		"hosts":      []string{"gpu-1"},
+		"kmsgpath":   "/nonexistent/kmsg",
+	})
+	events, err := f.Fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 {
+		t.Fatalf("expected no events for a remote host, got %v", events)
+	}
+}
+
+func TestFetchFromXidErrors(t *testing.T) {
+	gpuDevices := []nvidiadocker.DeviceStatus{
+		{
+			Index: toUintP(0),
+			UUID:  "GPU-66a2874a-837d-cd53-ab26-0d2d842d9822",
+			PCI:   nvidiadocker.PCIInfo{BusID: "00000000:08:00.0"},
+		},
+		{
+			Index: toUintP(1),
+			UUID:  "GPU-535c289c-6dd8-e308-b4ca-524b0fc07fa6",
+			PCI:   nvidiadocker.PCIInfo{BusID: "00000000:0B:00.0"},
+		},
+	}
+	containers := []*nvidiadocker.Container{
+		{ID: "id1", Name: "name1", Env: []string{"NVIDIA_VISIBLE_DEVICES=1"}},
+		{ID: "id2", Name: "name2", Env: []string{"NVIDIA_VISIBLE_DEVICES=0"}},
+	}
+	xidErrors := []xidError{
+		{code: 79, busID: "0000:0b:00", message: "pid=42, name=python, GPU has fallen off the bus.", pid: 42, process: "python"},
+		{code: 999, busID: "0000:3b:00", message: "Unknown error"},
+	}
+
+	events := fetchFromXidErrors(xidErrors, gpuDevices, containers, nil)
+	if len(events) != 2 {
+		t.Fatalf("expected an event per Xid error, got %d", len(events))
+	}
+
+	expected := common.MapStr{
+		"code":        79,
+		"severity":    "critical",
+		"description": "GPU has fallen off the bus",
+		"message":     "pid=42, name=python, GPU has fallen off the bus.",
+		"pci":         common.MapStr{"busid": "0000:0b:00"},
+		"process":     common.MapStr{"pid": uint(42), "name": "python"},
+		"gpu": common.MapStr{
+			"index": 1,
+			"uuid":  "GPU-535c289c-6dd8-e308-b4ca-524b0fc07fa6",
+		},
+		"containers": common.MapStr{
+			"count": 1,
+			"ids":   []string{"id1"},
+			"names": []string{"name1"},
+		},
+	}
+	if !reflect.DeepEqual(events[0], expected) {
+		t.Fatalf("expected %v, got %v", expected, events[0])
+	}
+
+	if severity, _ := events[1].GetValue("severity"); severity != "unknown" {
+		t.Fatalf("expected an unknown severity for an unknown code, got %v", severity)
+	}
+	if _, err := events[1].GetValue("gpu"); err == nil {
+		t.Fatalf("expected no GPU for an unknown bus ID, got %v", events[1])
+	}
+	if count, _ := events[1].GetValue("containers.count"); count != 0 {
+		t.Fatalf("expected no containers for an unknown bus ID, got %v", count)
+	}
+}
+
+func toUintP(val uint) *uint {
+	return &val
+}